@@ -0,0 +1,253 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// bounds of adaptive bulk size, the max is below the default 100mb
+// http.max_content_length of elasticsearch
+const (
+	adaptiveMinBulkSize = 256 * 1024
+	adaptiveMaxBulkSize = 95 * 1000000
+)
+
+// interval of polling thread pool stats of the target
+const threadPoolStatsInterval = 10 * time.Second
+
+// BulkController adjust bulk size and the number of concurrent bulk requests
+// by observed throughput, latency and rejections of the target, it backs off
+// on rejections or high latency, otherwise grows the size and concurrency in
+// turn, and undoes the last growth if throughput drops
+type BulkController struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	size          int //bytes of a bulk request
+	workers       int //concurrent bulk requests allowed
+	maxWorkers    int
+	running       int
+	targetLatency time.Duration
+
+	//observations of the current window
+	windowStart    time.Time
+	windowBulks    int
+	windowDocs     int
+	windowLatency  time.Duration
+	windowRejected int
+
+	//thread pool stats of the target
+	queued   bool
+	rejected int64
+
+	lastThroughput float64
+	lastGrowth     string //size or workers
+	lastSize       int
+	lastWorkers    int
+
+	done chan struct{}
+}
+
+func NewBulkController(bulkSize int, maxWorkers int, targetLatency time.Duration) *BulkController {
+	if bulkSize < adaptiveMinBulkSize {
+		bulkSize = adaptiveMinBulkSize
+	}
+	if bulkSize > adaptiveMaxBulkSize {
+		bulkSize = adaptiveMaxBulkSize
+	}
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	b := &BulkController{
+		size:          bulkSize,
+		workers:       maxWorkers,
+		maxWorkers:    maxWorkers,
+		targetLatency: targetLatency,
+		windowStart:   time.Now(),
+		rejected:      -1,
+		done:          make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+// BulkSize returns the current bulk size, or the default if not adaptive
+func (b *BulkController) BulkSize(defaultSize int) int {
+	if b == nil {
+		return defaultSize
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.size
+}
+
+// Workers returns the number of concurrent bulk requests allowed
+func (b *BulkController) Workers() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.workers
+}
+
+// Acquire block until a bulk request is allowed to be sent
+func (b *BulkController) Acquire() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	for b.running >= b.workers {
+		b.cond.Wait()
+	}
+	b.running++
+	b.lock.Unlock()
+}
+
+func (b *BulkController) Release() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	b.running--
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+// Observe record a bulk request, docs is the number of documents written
+func (b *BulkController) Observe(docs int, latency time.Duration, rejected int) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.windowBulks++
+	b.windowDocs += docs
+	b.windowLatency += latency
+	b.windowRejected += rejected
+
+	window := 2 * b.workers
+	if window < 4 {
+		window = 4
+	}
+	if b.windowBulks >= window || rejected > 0 {
+		b.adjust(time.Now())
+	}
+}
+
+// adjust the size and workers at the end of a window, called with lock held
+func (b *BulkController) adjust(now time.Time) {
+	elapsed := now.Sub(b.windowStart).Seconds()
+	if elapsed <= 0 {
+		elapsed = 0.001
+	}
+	throughput := float64(b.windowDocs) / elapsed
+	latency := b.windowLatency / time.Duration(b.windowBulks)
+	size, workers := b.size, b.workers
+
+	switch {
+	case b.windowRejected > 0:
+		b.size = maxInt(adaptiveMinBulkSize, b.size/2)
+		b.workers = maxInt(1, b.workers-1)
+		b.lastGrowth = ""
+	case latency > b.targetLatency:
+		b.size = maxInt(adaptiveMinBulkSize, b.size*3/4)
+		b.lastGrowth = ""
+	case len(b.lastGrowth) > 0 && throughput < b.lastThroughput*0.95:
+		//the last growth made it slower, undo it
+		b.size, b.workers = b.lastSize, b.lastWorkers
+		b.lastGrowth = ""
+	case b.queued:
+		//requests are queued by the target, growing doesn't help
+		b.lastGrowth = ""
+	default:
+		b.lastSize, b.lastWorkers = b.size, b.workers
+		if b.size < adaptiveMaxBulkSize && (b.lastGrowth != "size" || b.workers >= b.maxWorkers) {
+			b.size = minInt(adaptiveMaxBulkSize, b.size*5/4)
+			b.lastGrowth = "size"
+		} else if b.workers < b.maxWorkers {
+			b.workers++
+			b.lastGrowth = "workers"
+		} else {
+			b.lastGrowth = ""
+		}
+	}
+
+	if size != b.size || workers != b.workers {
+		log.Debugf("adaptive bulk, size: %d -> %d, workers: %d -> %d, throughput: %.0f docs/s, latency: %s, rejected: %d",
+			size, b.size, workers, b.workers, throughput, latency, b.windowRejected)
+	}
+	b.cond.Broadcast()
+
+	b.lastThroughput = throughput
+	b.windowStart = now
+	b.windowBulks, b.windowDocs, b.windowLatency, b.windowRejected = 0, 0, 0, 0
+}
+
+// setThreadPoolStats record stats of the target, new rejections are counted
+// as rejections of the window, queued tasks stop growing
+func (b *BulkController) setThreadPoolStats(stats *ThreadPoolStats) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rejected >= 0 && stats.Rejected > b.rejected {
+		b.windowRejected += int(stats.Rejected - b.rejected)
+	}
+	b.rejected = stats.Rejected
+	b.queued = stats.Queue > 0
+}
+
+// Start poll thread pool stats of the target in the background
+func (b *BulkController) Start(api ESAPI) {
+	go func() {
+		ticker := time.NewTicker(threadPoolStatsInterval)
+		defer ticker.Stop()
+		for {
+			stats, err := api.GetThreadPoolStats()
+			if err != nil {
+				log.Debug("failed to get thread pool stats, ", err)
+			} else {
+				b.setThreadPoolStats(stats)
+			}
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (b *BulkController) Stop() {
+	close(b.done)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBulkController(test *testing.T) {
+	var controller *BulkController
+	if controller.BulkSize(5000000) != 5000000 {
+		test.Fatal("nil controller should use the default size")
+	}
+	controller.Acquire()
+	controller.Release()
+	controller.Observe(100, time.Second, 0)
+
+	controller = NewBulkController(1000000, 2, time.Second)
+	observe := func(n int, latency time.Duration, rejected int) {
+		for i := 0; i < n; i++ {
+			controller.Observe(1000, latency, rejected)
+		}
+	}
+
+	observe(4, 100*time.Millisecond, 0)
+	if size := controller.BulkSize(0); size != 1250000 {
+		test.Fatal("size should grow when fast", size)
+	}
+
+	observe(1, 100*time.Millisecond, 10)
+	if size, workers := controller.BulkSize(0), controller.Workers(); size != 625000 || workers != 1 {
+		test.Fatal("size and workers should shrink on rejections", size, workers)
+	}
+
+	observe(4, 2*time.Second, 0)
+	if size := controller.BulkSize(0); size != 468750 {
+		test.Fatal("size should shrink when slow", size)
+	}
+
+	for i := 0; i < 1000; i++ {
+		controller.setThreadPoolStats(&ThreadPoolStats{Rejected: 5})
+		observe(4, 100*time.Millisecond, 0)
+	}
+	if size, workers := controller.BulkSize(0), controller.Workers(); size != adaptiveMaxBulkSize || workers != 2 {
+		test.Fatal("size and workers should be limited", size, workers)
+	}
+
+	controller.setThreadPoolStats(&ThreadPoolStats{Rejected: 6})
+	observe(4, 100*time.Millisecond, 0)
+	if workers := controller.Workers(); workers != 1 {
+		test.Fatal("workers should shrink on thread pool rejections", workers)
+	}
+}
+
+func TestParseBulkResponse(test *testing.T) {
+	data := []byte(`{"create":{"_index":"a","_type":"doc","_id":"1"}}
+{"f":1}
+{"delete":{"_index":"a","_type":"doc","_id":"2"}}
+{"create":{"_index":"a","_type":"doc","_id":"3"}}
+{"f":3}
+{"create":{"_index":"a","_type":"doc","_id":"4"}}
+{"f":4}
+`)
+	body := []byte(`{"errors":true,"items":[
+{"create":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},
+{"delete":{"status":200}},
+{"create":{"status":409,"error":{"type":"version_conflict_engine_exception"}}},
+{"create":{"status":429,"error":"EsRejectedExecutionException[rejected execution]"}}]}`)
+
+	result, retry, err := parseBulkResponse(data, body)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if result.Docs != 4 || result.Failed != 3 || result.Rejected != 2 {
+		test.Fatal("unexpected result", result)
+	}
+	if result.Reasons["version_conflict_engine_exception"] != 1 || result.Reasons["EsRejectedExecutionException"] != 1 {
+		test.Fatal("unexpected reasons", result.Reasons)
+	}
+	expected := `{"create":{"_index":"a","_type":"doc","_id":"1"}}
+{"f":1}
+{"create":{"_index":"a","_type":"doc","_id":"4"}}
+{"f":4}
+`
+	if string(retry) != expected {
+		test.Fatal("unexpected retry lines", string(retry))
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// NewAuth returns the auth of a cluster, one of basic auth, api key or token,
+// nil is returned if none is set
+func NewAuth(basic string, apiKey string, token string) (*Auth, error) {
+	set := 0
+	for _, v := range []string{basic, apiKey, token} {
+		if len(v) > 0 {
+			set++
+		}
+	}
+	if set == 0 {
+		return nil, nil
+	}
+	if set > 1 {
+		return nil, errors.New("only one of basic auth, api key and token can be set")
+	}
+
+	if len(basic) > 0 {
+		//split on the first colon only, passwords may contain colons
+		i := strings.Index(basic, ":")
+		if i <= 0 {
+			return nil, errors.New("invalid basic auth, ie: user:pass")
+		}
+		return &Auth{User: basic[:i], Pass: basic[i+1:]}, nil
+	}
+
+	if len(apiKey) > 0 {
+		//id:key is encoded, the encoded key is used as it is
+		if strings.Contains(apiKey, ":") {
+			apiKey = base64.StdEncoding.EncodeToString([]byte(apiKey))
+		}
+		return &Auth{APIKey: apiKey}, nil
+	}
+
+	return &Auth{Token: token}, nil
+}
+
+// Authorization returns the value of the Authorization header
+func (auth *Auth) Authorization() string {
+	if len(auth.APIKey) > 0 {
+		return "ApiKey " + auth.APIKey
+	}
+	if len(auth.Token) > 0 {
+		return "Bearer " + auth.Token
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.User+":"+auth.Pass))
+}
+
+// loadCredential returns the credential of an option, read from the file if
+// the value starts with @
+func loadCredential(value string) (string, error) {
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(value[1:])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// loadAuth returns the auth of a cluster from the options, env vars are read
+// if no option is set, prefix of env vars is ESM_SOURCE or ESM_DEST
+func loadAuth(basic string, apiKey string, token string, prefix string) (*Auth, error) {
+	if len(basic) == 0 && len(apiKey) == 0 && len(token) == 0 {
+		basic = os.Getenv(prefix + "_AUTH")
+		apiKey = os.Getenv(prefix + "_API_KEY")
+		token = os.Getenv(prefix + "_TOKEN")
+	}
+
+	var err error
+	if basic, err = loadCredential(basic); err != nil {
+		return nil, err
+	}
+	if apiKey, err = loadCredential(apiKey); err != nil {
+		return nil, err
+	}
+	if token, err = loadCredential(token); err != nil {
+		return nil, err
+	}
+	return NewAuth(basic, apiKey, token)
+}
+
+// newAWSAuth returns the auth signing requests with aws signature v4, other
+// auth of the cluster is not allowed
+func newAWSAuth(auth *Auth, region string, service string, profile string) (*Auth, error) {
+	if auth != nil {
+		return nil, errors.New("aws signature can't be used with basic auth, api key or token")
+	}
+	signer, err := NewAWSSigner(region, service, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &Auth{AWS: signer}, nil
+}
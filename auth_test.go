@@ -0,0 +1,82 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuth(test *testing.T) {
+	auth, err := NewAuth("elastic:pa:ss:", "", "")
+	if err != nil || auth.User != "elastic" || auth.Pass != "pa:ss:" {
+		test.Fatal("colons in password should be kept", auth, err)
+	}
+	if _, err = NewAuth("elastic", "", ""); err == nil {
+		test.Fatal("basic auth without password should be rejected")
+	}
+	if _, err = NewAuth("elastic:pass", "", "token"); err == nil {
+		test.Fatal("more than one auth should be rejected")
+	}
+
+	auth, _ = NewAuth("", "id:key", "")
+	if auth.Authorization() != "ApiKey aWQ6a2V5" {
+		test.Fatal("unexpected api key header", auth.Authorization())
+	}
+	auth, _ = NewAuth("", "aWQ6a2V5", "")
+	if auth.Authorization() != "ApiKey aWQ6a2V5" {
+		test.Fatal("unexpected encoded api key header", auth.Authorization())
+	}
+
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+	ioutil.WriteFile(file, []byte("secret\n"), 0600)
+
+	auth, err = loadAuth("", "", "@"+file, "ESM_TEST")
+	if err != nil || auth.Authorization() != "Bearer secret" {
+		test.Fatal("token should be read from file", auth, err)
+	}
+
+	os.Setenv("ESM_TEST_AUTH", "elastic:changeme")
+	defer os.Unsetenv("ESM_TEST_AUTH")
+	auth, err = loadAuth("", "", "", "ESM_TEST")
+	if err != nil || auth.User != "elastic" || auth.Pass != "changeme" {
+		test.Fatal("basic auth should be read from env", auth, err)
+	}
+	auth, err = loadAuth("", "id:key", "", "ESM_TEST")
+	if err != nil || auth.APIKey != "aWQ6a2V5" {
+		test.Fatal("env should be ignored if an option is set", auth, err)
+	}
+
+	headers := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("Authorization"))
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	client, _ := NewHTTPClient(nil, auth, "", nil, nil)
+	client.Get(server.URL)
+	client.Request("DELETE", server.URL, nil)
+	if len(headers) != 2 || headers[0] != "ApiKey aWQ6a2V5" || headers[1] != "ApiKey aWQ6a2V5" {
+		test.Fatal("unexpected authorization headers", headers)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	awsSignAlgorithm  = "AWS4-HMAC-SHA256"
+	awsTimeFormat     = "20060102T150405Z"
+	awsDefaultService = "es"
+)
+
+type AWSCredentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// AWSSigner sign requests with aws signature version 4, for amazon hosted
+// elasticsearch and opensearch domains
+type AWSSigner struct {
+	Credentials *AWSCredentials
+	Region      string
+	Service     string //es, or aoss for opensearch serverless
+}
+
+// NewAWSSigner returns the signer of region and service, the region is read
+// from env AWS_REGION or AWS_DEFAULT_REGION if not specified, credentials are
+// read from env, or the profile of the shared credentials file
+func NewAWSSigner(region string, service string, profile string) (*AWSSigner, error) {
+	if len(region) == 0 {
+		region = os.Getenv("AWS_REGION")
+	}
+	if len(region) == 0 {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if len(region) == 0 {
+		return nil, errors.New("aws region is required to sign requests")
+	}
+	if len(service) == 0 {
+		service = awsDefaultService
+	}
+	credentials, err := LoadAWSCredentials(profile)
+	if err != nil {
+		return nil, err
+	}
+	return &AWSSigner{Credentials: credentials, Region: region, Service: service}, nil
+}
+
+// LoadAWSCredentials returns credentials of env AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or the profile of the shared
+// credentials file if env is not set or the profile is specified, the profile
+// is read from env AWS_PROFILE if not specified
+func LoadAWSCredentials(profile string) (*AWSCredentials, error) {
+	if len(profile) == 0 && len(os.Getenv("AWS_ACCESS_KEY_ID")) > 0 {
+		credentials := &AWSCredentials{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if len(credentials.SecretKey) == 0 {
+			return nil, errors.New("AWS_SECRET_ACCESS_KEY is not set")
+		}
+		return credentials, nil
+	}
+
+	if len(profile) == 0 {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if len(profile) == 0 {
+		profile = "default"
+	}
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if len(file) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	return loadAWSCredentialsFile(file, profile)
+}
+
+// loadAWSCredentialsFile read a profile of the ini formatted credentials file
+func loadAWSCredentialsFile(file string, profile string) (*AWSCredentials, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	credentials := &AWSCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		i := strings.Index(line, "=")
+		if section != profile || i <= 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[i+1:])
+		switch strings.ToLower(strings.TrimSpace(line[:i])) {
+		case "aws_access_key_id":
+			credentials.AccessKey = value
+		case "aws_secret_access_key":
+			credentials.SecretKey = value
+		case "aws_session_token":
+			credentials.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(credentials.AccessKey) == 0 || len(credentials.SecretKey) == 0 {
+		return nil, fmt.Errorf("aws credentials of profile %s not found in %s", profile, file)
+	}
+	return credentials, nil
+}
+
+// Sign add the Authorization and X-Amz-Date headers to the request, host and
+// x-amz-* headers are signed, body is the payload of the request
+func (s *AWSSigner) Sign(req *http.Request, body []byte, t time.Time) {
+	t = t.UTC()
+	date := t.Format(awsTimeFormat)
+	req.Header.Set("X-Amz-Date", date)
+	if len(s.Credentials.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", s.Credentials.SessionToken)
+	}
+
+	canonicalHeaders, signedHeaders := awsCanonicalHeaders(req)
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.EscapedPath(), false),
+		awsCanonicalQuery(req),
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date[:8], s.Region, s.Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{awsSignAlgorithm, date, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + s.Credentials.SecretKey)
+	for _, v := range []string{date[:8], s.Region, s.Service, "aws4_request"} {
+		key = awsHMAC(key, v)
+	}
+	signature := hex.EncodeToString(awsHMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSignAlgorithm, s.Credentials.AccessKey, scope, signedHeaders, signature))
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func awsCanonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.Join(strings.Fields(strings.Join(v, ",")), " ")
+		}
+	}
+
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonical := ""
+	for _, k := range names {
+		canonical += k + ":" + headers[k] + "\n"
+	}
+	return canonical, strings.Join(names, ";")
+}
+
+func awsCanonicalQuery(req *http.Request) string {
+	params := []string{}
+	for k, values := range req.URL.Query() {
+		for _, v := range values {
+			params = append(params, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsEscape escape all but unreserved characters, slashes of paths are kept
+func awsEscape(s string, escapeSlash bool) string {
+	buf := strings.Builder{}
+	for _, c := range []byte(s) {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("%%%02X", c))
+	}
+	return buf.String()
+}
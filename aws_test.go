@@ -0,0 +1,102 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAWSSigner(test *testing.T) {
+	credentials := &AWSCredentials{AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+	//get-vanilla of the aws signature v4 test suite
+	signer := &AWSSigner{Credentials: credentials, Region: "us-east-1", Service: "service"}
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signer.Sign(req, nil, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if req.Header.Get("Authorization") != expected {
+		test.Fatal("unexpected signature", req.Header.Get("Authorization"))
+	}
+
+	//the stub signs received requests again, to validate what is on the wire
+	signer = &AWSSigner{Credentials: credentials, Region: "us-east-1", Service: "es"}
+	invalid := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		t, err := time.Parse(awsTimeFormat, r.Header.Get("X-Amz-Date"))
+		received := r.Header.Get("Authorization")
+		r.URL.Host = r.Host
+		r.Header.Del("Authorization")
+		signer.Sign(r, body, t)
+		if err != nil || received != r.Header.Get("Authorization") {
+			invalid++
+			w.WriteHeader(403)
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client, _ := NewHTTPClient(nil, &Auth{AWS: signer}, "", nil, nil)
+	if _, _, errs := client.Get(server.URL+"/logs-*,app/_search?scroll=1m&size=10"); errs != nil {
+		test.Fatal(errs)
+	}
+	if _, _, errs := client.Post(server.URL+"/_search/scroll", `{"scroll":"1m","scroll_id":"a b+c"}`); errs != nil {
+		test.Fatal(errs)
+	}
+	if _, err := client.Request("PUT", server.URL+"/idx", bytes.NewBufferString(`{"settings":{}}`)); err != nil {
+		test.Fatal(err)
+	}
+	if _, err := client.Request("DELETE", server.URL+"/idx", nil); err != nil {
+		test.Fatal(err)
+	}
+	if invalid > 0 {
+		test.Fatal("invalid signatures", invalid)
+	}
+}
+
+func TestLoadAWSCredentials(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "credentials")
+	ioutil.WriteFile(file, []byte("[default]\naws_access_key_id = A\naws_secret_access_key = B\n\n# comment\n[migrate]\naws_access_key_id=C\naws_secret_access_key=D\naws_session_token=E\n"), 0600)
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", file)
+	defer os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+
+	credentials, err := LoadAWSCredentials("migrate")
+	if err != nil || credentials.AccessKey != "C" || credentials.SecretKey != "D" || credentials.SessionToken != "E" {
+		test.Fatal("unexpected credentials of profile", credentials, err)
+	}
+	if _, err = LoadAWSCredentials("missing"); err == nil {
+		test.Fatal("missing profile should be rejected")
+	}
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "F")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "G")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	credentials, err = LoadAWSCredentials("")
+	if err != nil || credentials.AccessKey != "F" || credentials.SecretKey != "G" {
+		test.Fatal("env credentials should be used first", credentials, err)
+	}
+}
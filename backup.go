@@ -0,0 +1,284 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// a backup archive is a tar file of:
+//   manifest.json    the dump manifest, settings, mappings, aliases and counts
+//   data/*           compressed dump parts, one or more per index
+//   SHA256SUMS       checksums of all above, in the format of sha256sum
+const (
+	backupManifestName = "manifest.json"
+	backupDataDir      = "data"
+	backupChecksumName = "SHA256SUMS"
+)
+
+type BackupCommand struct {
+	Archive string `long:"archive" description:"backup archive file to write, ie: backup.tar" required:"true"`
+	TempDir string `long:"temp_dir" description:"directory for temporary dump files, system temp directory is used if not specified"`
+}
+
+type RestoreCommand struct {
+	Archive string `long:"archive" description:"backup archive file to restore, ie: backup.tar" required:"true"`
+	TempDir string `long:"temp_dir" description:"directory for temporary extracted files, system temp directory is used if not specified"`
+}
+
+// Prepare set up a dump of source indexes into a temporary directory, the
+// returned directory should be removed after finished
+func (b *BackupCommand) Prepare(c *Config) (string, error) {
+	if len(c.SourceEs) == 0 {
+		return "", errors.New("source elasticsearch instance is required for backup")
+	}
+	if len(c.TargetEs) > 0 || len(c.DumpOutFile) > 0 || len(c.DumpInputFile) > 0 {
+		return "", errors.New("dest, output_file and input_file can't be used with backup")
+	}
+
+	dir, err := ioutil.TempDir(b.TempDir, "esm-backup")
+	if err != nil {
+		return "", err
+	}
+
+	ext := ".json.gz"
+	if compression, _ := getCompression("", c.Compress); compression == "zstd" {
+		ext = ".json.zst"
+	}
+	c.DumpOutFile = filepath.Join(dir, "data"+ext)
+	c.DumpPerIndex = true
+	return dir, nil
+}
+
+// Finish pack dump files and the manifest into the archive
+func (b *BackupCommand) Finish(c *Config, dir string) error {
+	manifestFile := c.DumpOutFile + dumpManifestSuffix
+	if !checkFileIsExist(manifestFile) {
+		return errors.New("dump manifest not found, backup failed")
+	}
+
+	files, err := ListDumpFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(b.Archive)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	tw := tar.NewWriter(w)
+
+	checksums := []string{}
+	add := func(file, name string) error {
+		sum, err := addTarFile(tw, file, name)
+		if err != nil {
+			return err
+		}
+		checksums = append(checksums, fmt.Sprintf("%s  %s\n", sum, name))
+		return nil
+	}
+
+	err = add(manifestFile, backupManifestName)
+	for _, file := range files {
+		if err != nil {
+			break
+		}
+		err = add(file, path.Join(backupDataDir, filepath.Base(file)))
+	}
+
+	if err == nil {
+		sums := []byte(strings.Join(checksums, ""))
+		err = tw.WriteHeader(&tar.Header{Name: backupChecksumName, Mode: 0644, Size: int64(len(sums)), ModTime: time.Now()})
+		if err == nil {
+			_, err = tw.Write(sums)
+		}
+	}
+
+	if e := tw.Close(); e != nil && err == nil {
+		err = e
+	}
+	if e := w.Flush(); e != nil && err == nil {
+		err = e
+	}
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(b.Archive)
+		return err
+	}
+
+	log.Infof("backup archive %s written, %d files", b.Archive, len(files))
+	return nil
+}
+
+func addTarFile(tw *tar.Writer, file, name string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return "", err
+	}
+	header.Name = name
+	if err = tw.WriteHeader(header); err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tw, hash), f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Prepare extract the archive into a temporary directory, verify checksums
+// and set up loading from it, indexes are created from the manifest
+func (r *RestoreCommand) Prepare(c *Config) (string, error) {
+	if len(c.TargetEs) == 0 {
+		return "", errors.New("dest elasticsearch instance is required for restore")
+	}
+	if len(c.SourceEs) > 0 || len(c.DumpOutFile) > 0 || len(c.DumpInputFile) > 0 {
+		return "", errors.New("source, output_file and input_file can't be used with restore")
+	}
+
+	dir, err := ioutil.TempDir(r.TempDir, "esm-restore")
+	if err != nil {
+		return "", err
+	}
+
+	err = extractBackup(r.Archive, dir)
+	if err != nil {
+		return dir, err
+	}
+
+	c.DumpInputFile = filepath.Join(dir, backupDataDir)
+	c.InputManifest = restoredManifestFile(dir)
+	c.CopyIndexSettings = true
+	c.CopyIndexMappings = true
+	return dir, nil
+}
+
+func restoredManifestFile(dir string) string {
+	return filepath.Join(dir, backupDataDir, "backup"+dumpManifestSuffix)
+}
+
+func extractBackup(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = os.MkdirAll(filepath.Join(dir, backupDataDir), 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(bufio.NewReader(f))
+	checksums := map[string]string{}
+	expected := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(header.Name)
+		if name == backupChecksumName {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if fields := strings.Fields(line); len(fields) == 2 {
+					expected[fields[1]] = fields[0]
+				}
+			}
+			continue
+		}
+
+		if name != backupManifestName && (path.Dir(name) != backupDataDir || strings.HasPrefix(path.Base(name), ".")) {
+			log.Warn("skip unknown file in archive, ", header.Name)
+			continue
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if name == backupManifestName {
+			//keep the manifest next to dump parts, the same as a plain dump
+			target = restoredManifestFile(dir)
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, hash), tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+		checksums[name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if len(expected) == 0 {
+		return errors.New("no checksums found in archive " + archive)
+	}
+
+	names := []string{}
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if checksums[name] != expected[name] {
+			return fmt.Errorf("checksum mismatch of %s in archive %s", name, archive)
+		}
+	}
+	if len(checksums) != len(expected) {
+		return errors.New("files without checksum found in archive " + archive)
+	}
+
+	log.Infof("backup archive %s extracted, %d files verified", archive, len(checksums))
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupArchive(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+
+	c := &Config{SourceEs: "http://localhost:9200"}
+	backup := &BackupCommand{Archive: filepath.Join(dir, "backup.tar"), TempDir: dir}
+	workDir, err := backup.Prepare(c)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	w := &DumpWriter{File: c.DumpOutFile, PerIndex: c.DumpPerIndex}
+	w.Write("a", []byte("{\"_id\":\"1\"}\n"))
+	w.Close()
+	manifest := &DumpManifest{Indices: map[string]*DumpIndexManifest{}}
+	manifest.SetDumpResult(w.Counts(), w.Files())
+	manifest.Write(c.DumpOutFile + dumpManifestSuffix)
+
+	if err = backup.Finish(c, workDir); err != nil {
+		test.Fatal(err)
+	}
+
+	restoreDir := filepath.Join(dir, "restore")
+	if err = extractBackup(backup.Archive, restoreDir); err != nil {
+		test.Fatal(err)
+	}
+	files, err := ListDumpFiles(filepath.Join(restoreDir, backupDataDir))
+	if err != nil || len(files) != 1 || filepath.Base(files[0]) != "data.a.json.gz" {
+		test.Fatalf("unexpected restored files %v, %v", files, err)
+	}
+
+	//corrupt the archive, restore should fail
+	data, _ := ioutil.ReadFile(backup.Archive)
+	data = bytes.Replace(data, []byte("\"docs\": 1"), []byte("\"docs\": 2"), 1)
+	ioutil.WriteFile(backup.Archive, data, 0644)
+	if err = extractBackup(backup.Archive, filepath.Join(dir, "corrupted")); err == nil {
+		test.Error("expected checksum mismatch")
+	}
+}
@@ -21,7 +21,11 @@ import (
 	log "github.com/cihub/seelog"
 	"encoding/json"
 	"bytes"
+	"fmt"
 	"gopkg.in/cheggaaa/pb.v1"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,15 +34,27 @@ func (c *Migrator) NewBulkWorker(docCount *int, pb *pb.ProgressBar, wg *sync.Wai
 	log.Debug("start es bulk worker")
 
 	bulkItemSize := 0
+	bulkSourceDocs := 0 //source documents of the buffer, progress is counted by them
 	mainBuf := bytes.Buffer{}
 	docBuf := bytes.Buffer{}
 	docEnc := json.NewEncoder(&docBuf)
+	missingIndex := false
+
+	transformer, err := c.NewDocTransformer()
+	if err != nil {
+		log.Error(err)
+		wg.Done()
+		return
+	}
+
+	// flush buffered documents periodically, to bound the latency of writes
+	flushTicker := time.NewTicker(c.Config.FlushInterval)
+	defer flushTicker.Stop()
 
 	READ_DOCS:
 	for {
 		select {
 		case docI, open := <-c.DocChan:
-			var err error
 			log.Trace("read doc from channel,", docI)
 		// this check is in case the document is an error with scroll stuff
 			if status, ok := docI["status"]; ok {
@@ -57,55 +73,81 @@ func (c *Migrator) NewBulkWorker(docCount *int, pb *pb.ProgressBar, wg *sync.Wai
 				}
 			}
 
-			var tempDestIndexName string
-			tempDestIndexName = docI["_index"].(string)
-
-			if c.Config.TargetIndexName != "" {
-				tempDestIndexName = c.Config.TargetIndexName
-			}
-
-			doc := Document{
-				Index:  tempDestIndexName,
-				Type:   docI["_type"].(string),
-				source: docI["_source"].(map[string]interface{}),
-				Id:     docI["_id"].(string),
-			}
-
 		// if channel is closed flush and gtfo
 			if !open {
 				goto WORKER_DONE
 			}
 
-		// sanity check
-			if len(doc.Index) == 0 || len(doc.Id) == 0 || len(doc.Type) == 0 {
-				log.Errorf("failed decoding document: %+v", doc)
+			docs, err := transformer.Transform(docI)
+			if err != nil {
+				log.Error("failed transforming document: ", err)
 				continue
 			}
-
-		// encode the doc and and the _source field for a bulk request
-			post := map[string]Document{
-				"create": doc,
-			}
-			if err = docEnc.Encode(post); err != nil {
-				log.Error(err)
+			// dropped by the script, counted so that totals match the source
+			if len(docs) == 0 {
+				atomic.AddInt64(&c.DroppedDocs, 1)
+				pb.Increment()
+				continue
 			}
-			if err = docEnc.Encode(doc.source); err != nil {
-				log.Error(err)
+
+			encoded := 0
+			for _, item := range docs {
+				tempDestIndexName, _ := item["_index"].(string)
+				if c.Config.TargetIndexName != "" {
+					tempDestIndexName = c.Config.TargetIndexName
+				}
+
+				doc := Document{Index: tempDestIndexName}
+				doc.Type, _ = item["_type"].(string)
+				if len(doc.Type) == 0 {
+					doc.Type = c.DefaultType
+				}
+				doc.Id, _ = item["_id"].(string)
+				doc.source, _ = item["_source"].(map[string]interface{})
+
+			// sanity check, documents without _id are created with generated ids
+				if len(doc.Index) == 0 {
+					if !missingIndex {
+						log.Error("documents without _index are skipped, use --dest_index to set the index")
+						missingIndex = true
+					}
+					continue
+				}
+				if doc.source == nil {
+					log.Errorf("failed decoding document: %+v", doc)
+					continue
+				}
+
+			// encode the doc and and the _source field for a bulk request
+				post := map[string]Document{
+					"create": doc,
+				}
+				if err = docEnc.Encode(post); err != nil {
+					log.Error(err)
+				}
+				if err = docEnc.Encode(doc.source); err != nil {
+					log.Error(err)
+				}
+				encoded++
 			}
 
-		// if we approach the 100mb es limit, flush to es and reset mainBuf
-			if mainBuf.Len() + docBuf.Len() > (c.Config.BulkSizeInMB * 1000000) {
-				goto CLEAN_BUFFER
+		// if we approach the 100mb es limit or the max number of actions, flush to es and reset mainBuf
+			if mainBuf.Len() + docBuf.Len() > c.BulkController.BulkSize(c.Config.BulkSizeInMB * 1000000) ||
+				(c.Config.BulkDocs > 0 && bulkItemSize + encoded > c.Config.BulkDocs) {
+				log.Trace("clean buffer, and execute bulk insert")
+				c.flushBulk(&mainBuf, bulkItemSize, bulkSourceDocs, pb)
+				bulkItemSize, bulkSourceDocs = 0, 0
 			}
 
 		// append the doc to the main buffer
 			mainBuf.Write(docBuf.Bytes())
 		// reset for next document
-			bulkItemSize++
+			bulkItemSize += encoded
+			bulkSourceDocs++
 			docBuf.Reset()
-			(*docCount)++
-		case <-time.After(time.Second * 5):
-			log.Debug("5s no message input")
+			(*docCount) += encoded
+		case <-flushTicker.C:
+			log.Tracef("flush interval %s reached", c.Config.FlushInterval)
 			goto CLEAN_BUFFER
 		case <-time.After(time.Minute * 5):
 			log.Warn("5m no message input, close worker")
@@ -115,20 +157,191 @@ func (c *Migrator) NewBulkWorker(docCount *int, pb *pb.ProgressBar, wg *sync.Wai
 		goto READ_DOCS
 
 		CLEAN_BUFFER:
-		c.TargetESAPI.Bulk(&mainBuf)
 		log.Trace("clean buffer, and execute bulk insert")
-		pb.Add(bulkItemSize)
-		bulkItemSize = 0
+		c.flushBulk(&mainBuf, bulkItemSize, bulkSourceDocs, pb)
+		bulkItemSize, bulkSourceDocs = 0, 0
 
 	}
 	WORKER_DONE:
-	if docBuf.Len() > 0 {
-		mainBuf.Write(docBuf.Bytes())
-		bulkItemSize++
-	}
-	c.TargetESAPI.Bulk(&mainBuf)
 	log.Trace("bulk insert")
-	pb.Add(bulkItemSize)
-	bulkItemSize = 0
+	c.flushBulk(&mainBuf, bulkItemSize, bulkSourceDocs, pb)
 	wg.Done()
 }
+
+// defaultDocType returns the type of documents without _type for the target
+// version, _doc is not a valid type name before 6.x, and types are removed
+// since 7.x
+func defaultDocType(version string) string {
+	major, _ := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if major >= 7 {
+		return ""
+	}
+	return "doc"
+}
+
+// backoff before retrying a bulk request, doubled on each retry
+const (
+	bulkRetryBackoff    = time.Second
+	maxBulkRetryBackoff = 30 * time.Second
+)
+
+// a bulk request is retried before its documents are given up
+const maxBulkRetries = 10
+
+// flushBulk send the bulk request of buf until its documents are written or
+// given up, docs is the number of bulk actions in it, and sources the number
+// of source documents, which are counted as progress, as a document may be
+// split into multiple actions by the script. documents rejected by the
+// target and requests failed to connect are retried with backoff, other
+// failed requests are not retried, as they fail again or may have been
+// applied, sending them again duplicates documents of generated ids
+func (c *Migrator) flushBulk(buf *bytes.Buffer, docs int, sources int, bar *pb.ProgressBar) {
+	defer bar.Add(sources)
+	backoff := bulkRetryBackoff
+	for retry := 0; buf.Len() > 0; retry++ {
+		if retry == maxBulkRetries {
+			log.Errorf("failed to write %d documents after %d retries", docs, maxBulkRetries)
+			c.Metrics.FailDocs("retries_exhausted", docs)
+			buf.Reset()
+			return
+		}
+		if retry > 0 {
+			time.Sleep(backoff)
+			backoff = minDuration(2*backoff, maxBulkRetryBackoff)
+		}
+		docs = c.sendBulk(buf, docs)
+	}
+}
+
+// sendBulk send the bulk request of buf once, documents to be retried are kept
+// in buf, returns the number of documents kept
+func (c *Migrator) sendBulk(buf *bytes.Buffer, docs int) int {
+	c.WriteLimiter.Wait(docs, buf.Len())
+	c.BulkController.Acquire()
+	size := buf.Len()
+	start := time.Now()
+	result, err := c.TargetESAPI.Bulk(buf)
+	latency := time.Since(start)
+	c.BulkController.Release()
+
+	if err != nil {
+		status := 0
+		reason := "request_error"
+		if result != nil {
+			status = result.Status
+			reason = fmt.Sprintf("status_%d", status)
+		}
+		rejected := 0
+		if status == 429 {
+			rejected = docs
+		}
+		c.BulkController.Observe(0, latency, rejected)
+
+		if status == 429 || (result == nil && requestNotSent(err)) {
+			log.Warnf("bulk request of %d documents failed, retry later, %v", docs, err)
+			c.Metrics.ObserveBulk(latency, map[string]int{reason: docs}, docs)
+			return docs
+		}
+		if status == 413 {
+			log.Errorf("bulk request of %d documents is too large, reduce --bulk_size or --bulk_docs, %v", docs, err)
+		} else if status == 0 || status >= 500 {
+			log.Errorf("bulk request of %d documents failed, not retried as it may have been applied, %v", docs, err)
+		} else {
+			log.Errorf("bulk request of %d documents failed, %v", docs, err)
+		}
+		c.Metrics.ObserveBulk(latency, map[string]int{reason: docs}, 0)
+		buf.Reset()
+		return 0
+	}
+
+	c.BulkController.Observe(docs-result.Rejected, latency, result.Rejected)
+	c.Metrics.ObserveBulk(latency, result.Reasons, result.Rejected)
+	c.Metrics.WriteDocs("es", docs-result.Failed, size)
+	if result.Failed > result.Rejected {
+		log.Warnf("%d of %d documents failed, %v", result.Failed-result.Rejected, result.Docs, result.Reasons)
+	}
+	if result.Rejected > 0 {
+		log.Debugf("%d documents rejected by target, retry later", result.Rejected)
+	}
+	return result.Rejected
+}
+
+// parseBulkResponse count failed actions of the bulk response, the action and
+// source lines of rejected actions are returned to be retried
+func parseBulkResponse(data []byte, body []byte) (*BulkResult, []byte, error) {
+	response := struct {
+		Errors bool                                  `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}{}
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &BulkResult{Status: 200, Docs: len(response.Items), Reasons: map[string]int{}}
+	if !response.Errors {
+		return result, nil, nil
+	}
+
+	retry := bytes.Buffer{}
+	lines := bytes.Split(data, []byte("\n"))
+	line := 0
+	for _, item := range response.Items {
+		for op, v := range item {
+			//skip empty lines between actions
+			for line < len(lines) && len(bytes.TrimSpace(lines[line])) == 0 {
+				line++
+			}
+			action := lines[line:]
+			if op == "delete" {
+				action = action[:1]
+			} else if len(action) > 2 {
+				action = action[:2]
+			}
+			line += len(action)
+
+			if v.Status < 300 {
+				continue
+			}
+			result.Failed++
+			result.Reasons[bulkErrorType(v.Status, v.Error)]++
+			if v.Status == 429 {
+				result.Rejected++
+				for _, l := range action {
+					retry.Write(l)
+					retry.WriteByte('\n')
+				}
+			}
+		}
+	}
+	return result, retry.Bytes(), nil
+}
+
+// bulkErrorType returns the type of error, which is a string before
+// elasticsearch 5.0, and an object with type since 5.0
+func bulkErrorType(status int, data json.RawMessage) string {
+	e := struct {
+		Type string `json:"type"`
+	}{}
+	if json.Unmarshal(data, &e) == nil && len(e.Type) > 0 {
+		return e.Type
+	}
+	str := ""
+	if json.Unmarshal(data, &str) == nil && len(str) > 0 {
+		if i := strings.IndexAny(str, "[ "); i > 0 {
+			return str[:i]
+		}
+		return str
+	}
+	return fmt.Sprintf("status_%d", status)
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
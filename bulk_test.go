@@ -0,0 +1,237 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+func TestBulkWorkerFlush(test *testing.T) {
+	lock := sync.Mutex{}
+	actions := []int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		actions = append(actions, bytes.Count(body, []byte("\n"))/2)
+		lock.Unlock()
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer server.Close()
+
+	client, _ := NewHTTPClient([]string{server.URL}, nil, "", nil, nil)
+	migrator := &Migrator{
+		Config:      &Config{BulkSizeInMB: 5, BulkDocs: 3, FlushInterval: 100 * time.Millisecond},
+		TargetESAPI: &ESAPIV0{Host: server.URL, Client: client},
+		DocChan:     make(chan map[string]interface{}, 10),
+	}
+	doc := func(i int) map[string]interface{} {
+		return map[string]interface{}{"_index": "a", "_type": "doc", "_id": fmt.Sprint(i), "_source": map[string]interface{}{"f": i}}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	count := 0
+	bar := pb.New(8)
+	bar.NotPrint = true
+	go migrator.NewBulkWorker(&count, bar, &wg)
+
+	for i := 0; i < 7; i++ {
+		migrator.DocChan <- doc(i)
+	}
+	time.Sleep(300 * time.Millisecond)
+	lock.Lock()
+	flushed := fmt.Sprint(actions)
+	lock.Unlock()
+	if flushed != "[3 3 1]" {
+		test.Fatal("documents should be flushed by count and interval", flushed)
+	}
+
+	migrator.DocChan <- doc(7)
+	close(migrator.DocChan)
+	wg.Wait()
+	if fmt.Sprint(actions) != "[3 3 1 1]" || count != 8 {
+		test.Fatal("unexpected bulk requests", actions, count)
+	}
+}
+
+func TestBulkWorkerDroppedDocs(test *testing.T) {
+	actions := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		actions += bytes.Count(body, []byte("\n")) / 2
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer server.Close()
+
+	//odd documents are dropped, even ones are split into two
+	script, _ := goja.Compile("drop.js", `function process(doc) {
+		return doc._source.f % 2 == 0 ? [doc, {_index: doc._index, _type: doc._type, _id: doc._id + "-copy", _source: doc._source}] : null;
+	}`, false)
+	client, _ := NewHTTPClient([]string{server.URL}, nil, "", nil, nil)
+	migrator := &Migrator{
+		Config:      &Config{BulkSizeInMB: 5, FlushInterval: time.Second},
+		TargetESAPI: &ESAPIV0{Host: server.URL, Client: client},
+		DocChan:     make(chan map[string]interface{}, 10),
+		Script:      script,
+	}
+	for i := 0; i < 5; i++ {
+		migrator.DocChan <- map[string]interface{}{"_index": "a", "_type": "doc", "_id": fmt.Sprint(i), "_source": map[string]interface{}{"f": i}}
+	}
+	close(migrator.DocChan)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	count := 0
+	bar := pb.New(5)
+	bar.NotPrint = true
+	migrator.NewBulkWorker(&count, bar, &wg)
+	//progress is counted by source documents
+	if actions != 6 || count != 6 || migrator.DroppedDocs != 2 || bar.Get() != 5 {
+		test.Fatal("dropped documents should be skipped and counted", actions, count, migrator.DroppedDocs, bar.Get())
+	}
+}
+
+func TestBulkWorkerGeneratedIds(test *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer server.Close()
+
+	//bulk file of another tool, with no _id and _index
+	decoder := &bulkDecoder{}
+	docs := []map[string]interface{}{}
+	for _, line := range []string{`{"index":{}}`, `{"f":1}`, `{"create":{"_type":"log"}}`, `{"f":2}`} {
+		doc, err := decoder.Decode([]byte(line))
+		if err != nil {
+			test.Fatal(err)
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+
+	client, _ := NewHTTPClient([]string{server.URL}, nil, "", nil, nil)
+	for version, expected := range map[string]string{
+		//_doc is not a valid type name of elasticsearch 5
+		"5.6.0": `{"create":{"_index":"dest","_type":"doc"}}
+{"f":1}
+{"create":{"_index":"dest","_type":"log"}}
+{"f":2}
+`,
+		"7.10.2": `{"create":{"_index":"dest"}}
+{"f":1}
+{"create":{"_index":"dest","_type":"log"}}
+{"f":2}
+`,
+	} {
+		migrator := &Migrator{
+			Config:      &Config{BulkSizeInMB: 5, FlushInterval: time.Second, TargetIndexName: "dest"},
+			TargetESAPI: &ESAPIV0{Host: server.URL, Client: client},
+			DocChan:     make(chan map[string]interface{}, 10),
+			DefaultType: defaultDocType(version),
+		}
+		for _, doc := range docs {
+			migrator.DocChan <- doc
+		}
+		close(migrator.DocChan)
+
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		count := 0
+		bar := pb.New(2)
+		bar.NotPrint = true
+		migrator.NewBulkWorker(&count, bar, &wg)
+		if string(body) != expected || count != 2 {
+			test.Fatal("documents without _id and _index should be loaded", version, count, string(body))
+		}
+	}
+}
+
+func TestBulkWorkerFailedRequest(test *testing.T) {
+	lock := sync.Mutex{}
+	requests := []string{}
+	busy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		ids := []string{}
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			if i := bytes.Index(line, []byte(`"_id":"`)); i >= 0 {
+				ids = append(ids, string(line[i+7:i+8]))
+			}
+		}
+		requests = append(requests, strings.Join(ids, ","))
+		switch {
+		case bytes.Contains(body, []byte("large")):
+			w.WriteHeader(413)
+		case bytes.Contains(body, []byte("busy")) && busy:
+			busy = false
+			w.WriteHeader(429)
+		case bytes.Contains(body, []byte("unavailable")):
+			w.WriteHeader(503)
+		default:
+			w.Write([]byte(`{"errors":false,"items":[]}`))
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewHTTPClient([]string{server.URL}, nil, "", nil, nil)
+	migrator := &Migrator{
+		Config:      &Config{BulkSizeInMB: 5, BulkDocs: 2, FlushInterval: time.Minute},
+		TargetESAPI: &ESAPIV0{Host: server.URL, Client: client},
+		DocChan:     make(chan map[string]interface{}, 10),
+	}
+	doc := func(i int, f string) map[string]interface{} {
+		return map[string]interface{}{"_index": "a", "_type": "doc", "_id": fmt.Sprint(i), "_source": map[string]interface{}{"f": f}}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	count := 0
+	bar := pb.New(8)
+	bar.NotPrint = true
+	go migrator.NewBulkWorker(&count, bar, &wg)
+
+	for i, f := range []string{"large", "ok", "ok", "busy", "unavailable", "ok", "ok", "ok"} {
+		migrator.DocChan <- doc(i, f)
+	}
+	close(migrator.DocChan)
+	wg.Wait()
+
+	//the request of 429 is retried, the requests of 413 and 503 are skipped,
+	//as the 503 one may have been applied
+	if fmt.Sprint(requests) != "[0,1 2,3 2,3 4,5 6,7]" {
+		test.Fatal("unexpected bulk requests", requests)
+	}
+	if bar.Get() != 8 {
+		test.Fatal("all documents should be done", bar.Get())
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// stdioFile is the file name of stdin and stdout, for pipelines
+const stdioFile = "-"
+
+// getCompression returns the compression of dump file, the compress option
+// wins, otherwise it is detected by the file extension
+func getCompression(file string, compress string) (string, error) {
+	switch strings.ToLower(compress) {
+	case "gzip", "gz":
+		return "gzip", nil
+	case "zstd", "zst":
+		return "zstd", nil
+	case "none":
+		return "", nil
+	case "":
+	default:
+		return "", errors.New("unsupported compression: " + compress + ", options: gzip,zstd,none")
+	}
+
+	switch {
+	case strings.HasSuffix(file, ".gz"):
+		return "gzip", nil
+	case strings.HasSuffix(file, ".zst"):
+		return "zstd", nil
+	}
+	return "", nil
+}
+
+// closers close compressor before the underlying file
+type closers []func() error
+
+func (c closers) Close() error {
+	var err error
+	for _, close := range c {
+		if e := close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type compressedReader struct {
+	io.Reader
+	closers
+}
+
+type compressedWriter struct {
+	io.Writer
+	closers
+}
+
+// OpenDumpFile open dump file for reading, decompress it if needed
+func OpenDumpFile(file string, compress string) (io.ReadCloser, error) {
+	compression, err := getCompression(file, compress)
+	if err != nil {
+		return nil, err
+	}
+
+	var f io.ReadCloser
+	if file == stdioFile {
+		f = ioutil.NopCloser(os.Stdin)
+	} else if f, err = os.Open(file); err != nil {
+		return nil, err
+	}
+	return newDumpReader(f, compression)
+}
+
+// newDumpReader decompress f if needed, f is closed with the returned reader
+func newDumpReader(f io.ReadCloser, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "gzip":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &compressedReader{Reader: gz, closers: closers{gz.Close, f.Close}}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &compressedReader{Reader: zr, closers: closers{func() error { zr.Close(); return nil }, f.Close}}, nil
+	}
+
+	return f, nil
+}
+
+// CreateDumpFile open dump file for writing, appending to the file if it is
+// exist and not truncated, gzip members and zstd frames can be concatenated,
+// so appending to compressed files is also fine, stdout is never closed
+func CreateDumpFile(file string, compress string, truncate bool) (io.WriteCloser, error) {
+	compression, err := getCompression(file, compress)
+	if err != nil {
+		return nil, err
+	}
+
+	var f io.WriteCloser
+	if file == stdioFile {
+		f = &compressedWriter{Writer: os.Stdout, closers: closers{}}
+	} else if !truncate && checkFileIsExist(file) {
+		f, err = os.OpenFile(file, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
+	} else {
+		f, err = os.Create(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case "gzip":
+		gz := gzip.NewWriter(f)
+		return &compressedWriter{Writer: gz, closers: closers{gz.Close, f.Close}}, nil
+	case "zstd":
+		zw, err := zstd.NewWriter(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &compressedWriter{Writer: zw, closers: closers{zw.Close, f.Close}}, nil
+	}
+
+	return f, nil
+}
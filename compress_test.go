@@ -0,0 +1,55 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressedDumpFile(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"dump.json", "dump.json.gz", "dump.json.zst"} {
+		file := filepath.Join(dir, name)
+
+		//write twice, the second one appends to the file
+		for _, line := range []string{"{\"_id\":\"1\"}\n", "{\"_id\":\"2\"}\n"} {
+			w, err := CreateDumpFile(file, "", false)
+			if err != nil {
+				test.Fatal(err)
+			}
+			w.Write([]byte(line))
+			if err = w.Close(); err != nil {
+				test.Fatal(err)
+			}
+		}
+
+		r, err := OpenDumpFile(file, "")
+		if err != nil {
+			test.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != "{\"_id\":\"1\"}\n{\"_id\":\"2\"}\n" {
+			test.Errorf("%s: unexpected content %q, %v", name, string(data), err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	log "github.com/cihub/seelog"
+)
+
+type rateLimits struct {
+	DocsPerSec  int   `json:"docs_per_sec"`
+	BytesPerSec int64 `json:"bytes_per_sec"`
+}
+
+// StartControlServer serve the control endpoint of a running migration in
+// the background, ie:
+//
+//	curl http://127.0.0.1:9700/rate
+//	curl -XPUT 'http://127.0.0.1:9700/rate?docs_per_sec=500&bytes_per_sec=1048576'
+func (c *Migrator) StartControlServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Infof("control endpoint listening on %s", listener.Addr())
+	go func() {
+		err := http.Serve(listener, c.newControlHandler())
+		log.Error("control endpoint stopped, ", err)
+	}()
+	return nil
+}
+
+func (c *Migrator) newControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rate", c.handleRate)
+	mux.HandleFunc("/metrics", c.handleMetrics)
+	return mux
+}
+
+// handleRate shows rate limits of reads and writes, and changes both of them
+// by PUT or POST, parameters not specified are kept, 0 for no limit
+func (c *Migrator) handleRate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" || r.Method == "POST" {
+		docs, bytes := c.WriteLimiter.Limits()
+		var err error
+		if v := r.URL.Query().Get("docs_per_sec"); len(v) > 0 {
+			if docs, err = strconv.Atoi(v); err != nil || docs < 0 {
+				http.Error(w, "invalid docs_per_sec: "+v, http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.URL.Query().Get("bytes_per_sec"); len(v) > 0 {
+			if bytes, err = strconv.ParseInt(v, 10, 64); err != nil || bytes < 0 {
+				http.Error(w, "invalid bytes_per_sec: "+v, http.StatusBadRequest)
+				return
+			}
+		}
+		c.ReadLimiter.SetLimits(docs, bytes)
+		c.WriteLimiter.SetLimits(docs, bytes)
+		log.Infof("rate limits changed, docs_per_sec: %d, bytes_per_sec: %d", docs, bytes)
+	} else if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limits := map[string]rateLimits{}
+	for name, limiter := range map[string]*RateLimiter{"read": c.ReadLimiter, "write": c.WriteLimiter} {
+		docs, bytes := limiter.Limits()
+		limits[name] = rateLimits{DocsPerSec: docs, BytesPerSec: bytes}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+// handleMetrics expose metrics of the migration in the prometheus text format
+func (c *Migrator) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if c.Metrics == nil {
+		http.Error(w, "metrics are not collected", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.Metrics.WriteTo(w, len(c.DocChan), cap(c.DocChan))
+}
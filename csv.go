@@ -0,0 +1,384 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// columns of csv and tsv files are dotted paths of _source fields, eg:
+// user.name, except _id, _index and _type, which are document metadata
+var csvMetaColumns = map[string]bool{"_id": true, "_index": true, "_type": true}
+
+var csvTypes = map[string]bool{
+	"string": true, "keyword": true, "text": true, "date": true,
+	"long": true, "integer": true, "short": true, "byte": true,
+	"float": true, "double": true, "boolean": true, "json": true,
+}
+
+type csvOptions struct {
+	comma          rune
+	columns        []string //selected columns, for all files
+	perIndex       bool
+	idColumn       string
+	types          map[string]string
+	arraySeparator string
+}
+
+// newCSVOptions returns options of csv or tsv format, default options are
+// used if the config is nil
+func newCSVOptions(format string, c *Config) (*csvOptions, error) {
+	opts := &csvOptions{comma: ',', idColumn: "_id", types: map[string]string{}, arraySeparator: "|"}
+	if format == dumpFormatTSV {
+		opts.comma = '\t'
+	}
+	if c == nil {
+		return opts, nil
+	}
+
+	if len(c.Fields) > 0 {
+		opts.columns = strings.Split(c.Fields, ",")
+	}
+	opts.perIndex = c.DumpPerIndex
+	if len(c.CSVIdColumn) > 0 {
+		opts.idColumn = c.CSVIdColumn
+	}
+	if len(c.CSVArraySeparator) > 0 {
+		opts.arraySeparator = c.CSVArraySeparator
+	}
+	types, err := parseCSVTypes(c.CSVTypes)
+	if err != nil {
+		return nil, err
+	}
+	opts.types = types
+	return opts, nil
+}
+
+// parseCSVTypes parse types of columns, eg: age:long,tags:keyword[]
+func parseCSVTypes(str string) (map[string]string, error) {
+	types := map[string]string{}
+	if len(strings.TrimSpace(str)) == 0 {
+		return types, nil
+	}
+	for _, item := range strings.Split(str, ",") {
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			return nil, errors.New("invalid csv column type: " + item + ", ie: age:long")
+		}
+		column, typ := strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		if !csvTypes[strings.TrimSuffix(typ, "[]")] {
+			return nil, errors.New("unsupported csv column type: " + typ)
+		}
+		types[column] = typ
+	}
+	return types, nil
+}
+
+// csvEncoder write the selected columns of documents, columns are taken from
+// index mappings, or the first document of the file if mappings are unknown,
+// nested objects are flattened into dotted columns, arrays of values are
+// joined by the array separator, other arrays and objects are written as json
+type csvEncoder struct {
+	opts           *csvOptions
+	mappingColumns []string            //sorted columns of index mappings
+	columns        map[string][]string //columns of files, by index if written per index
+	missing        map[string]bool     //fields warned of not being in columns
+}
+
+func (e *csvEncoder) Encode(doc map[string]interface{}) ([]byte, error) {
+	source, _ := doc["_source"].(map[string]interface{})
+	index, _ := doc["_index"].(string)
+	columns := e.fileColumns(index, source)
+
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		var v interface{}
+		if csvMetaColumns[column] {
+			v = doc[column]
+		} else {
+			v, _ = getFieldByPath(source, column)
+		}
+		record[i] = formatCSVValue(v, e.opts.arraySeparator)
+	}
+	return e.write(record)
+}
+
+// fileColumns returns columns of the file of the index, the header is already
+// written, so fields not in the columns are left out, warned once per field
+func (e *csvEncoder) fileColumns(index string, source map[string]interface{}) []string {
+	if len(e.opts.columns) > 0 {
+		return e.opts.columns
+	}
+	if !e.opts.perIndex {
+		index = ""
+	}
+	if e.columns == nil {
+		e.columns = map[string][]string{}
+		e.missing = map[string]bool{}
+	}
+
+	fields := flattenColumns(source, "")
+	columns, ok := e.columns[index]
+	if !ok {
+		if len(e.mappingColumns) > 0 {
+			columns = append([]string{"_id"}, e.mappingColumns...)
+		} else {
+			columns = append([]string{"_id"}, fields...)
+		}
+		e.columns[index] = columns
+		log.Debugf("csv columns of index %s, %v", index, columns)
+	}
+	for _, field := range fields {
+		if !hasCSVColumn(columns, field) && !e.missing[field] {
+			e.missing[field] = true
+			log.Warnf("field %s is not in csv columns, it is left out, use --fields to select columns", field)
+		}
+	}
+	return columns
+}
+
+// hasCSVColumn returns true if the field or its parent object is a column,
+// columns after _id are sorted
+func hasCSVColumn(columns []string, field string) bool {
+	for {
+		i := sort.SearchStrings(columns[1:], field)
+		if i < len(columns)-1 && columns[i+1] == field {
+			return true
+		}
+		dot := strings.LastIndex(field, ".")
+		if dot < 0 {
+			return false
+		}
+		field = field[:dot]
+	}
+}
+
+// Header returns the header line of columns, written at the beginning of files
+func (e *csvEncoder) Header(index string) []byte {
+	columns := e.opts.columns
+	if len(columns) == 0 {
+		if !e.opts.perIndex {
+			index = ""
+		}
+		columns = e.columns[index]
+	}
+	data, _ := e.write(columns)
+	return data
+}
+
+// tsv has no quoting, tabs, line breaks and backslashes of values are escaped
+var (
+	tsvEscaper   = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+	tsvUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+)
+
+func (e *csvEncoder) write(record []string) ([]byte, error) {
+	if e.opts.comma == '\t' {
+		fields := make([]string, len(record))
+		for i, v := range record {
+			fields[i] = tsvEscaper.Replace(v)
+		}
+		return []byte(strings.Join(fields, "\t") + "\n"), nil
+	}
+
+	buf := bytes.Buffer{}
+	w := csv.NewWriter(&buf)
+	w.Comma = e.opts.comma
+	w.Write(record)
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func flattenColumns(source map[string]interface{}, prefix string) []string {
+	columns := []string{}
+	for key, v := range source {
+		if obj, ok := v.(map[string]interface{}); ok && len(obj) > 0 {
+			columns = append(columns, flattenColumns(obj, prefix+key+".")...)
+			continue
+		}
+		columns = append(columns, prefix+key)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func formatCSVValue(v interface{}, arraySeparator string) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				data, _ := json.Marshal(v)
+				return string(data)
+			}
+			items = append(items, formatCSVValue(item, arraySeparator))
+		}
+		return strings.Join(items, arraySeparator)
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// csvDecoder map columns of the header to _source fields, typed by options,
+// empty cells are skipped, quoted values of csv may span multiple lines, tsv
+// values are not quoted, so stray quotes of other tools are kept as they are
+type csvDecoder struct {
+	opts    *csvOptions
+	header  []string
+	pending []byte
+	quotes  int //quotes of pending lines
+}
+
+// maxCSVRecordSize bound the lines buffered for a quoted value, otherwise an
+// unterminated quote takes the rest of the file as one record
+const maxCSVRecordSize = 16 * 1024 * 1024
+
+func (d *csvDecoder) Decode(line []byte) (map[string]interface{}, error) {
+	record, err := d.read(line)
+	if record == nil || err != nil {
+		return nil, err
+	}
+
+	if d.header == nil {
+		record[0] = strings.TrimPrefix(record[0], "\ufeff")
+		d.header = record
+		found := false
+		for _, column := range record {
+			found = found || column == d.opts.idColumn
+		}
+		if !found {
+			log.Warnf("id column %s not found in csv header, ids are generated by elasticsearch, use --csv_id_column to set it", d.opts.idColumn)
+		}
+		return nil, nil
+	}
+	if len(record) != len(d.header) {
+		return nil, fmt.Errorf("wrong number of csv fields, expected: %d, actual: %d", len(d.header), len(record))
+	}
+
+	source := map[string]interface{}{}
+	doc := map[string]interface{}{"_index": "", "_type": "", "_id": "", "_source": source}
+	for i, column := range d.header {
+		value := record[i]
+		if column == d.opts.idColumn {
+			doc["_id"] = value
+			continue
+		}
+		if csvMetaColumns[column] {
+			if len(value) > 0 {
+				doc[column] = value
+			}
+			continue
+		}
+		if len(value) == 0 {
+			continue
+		}
+		v, err := parseCSVValue(value, d.opts.types[column], d.opts.arraySeparator)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of column %s, %v", column, err)
+		}
+		setFieldByPath(source, column, v)
+	}
+	return doc, nil
+}
+
+// read returns the record of the line, nil if the line is empty or doesn't
+// complete a record
+func (d *csvDecoder) read(line []byte) ([]string, error) {
+	if d.opts.comma == '\t' {
+		line = bytes.TrimRight(line, "\r\n")
+		if len(bytes.TrimSpace(line)) == 0 {
+			return nil, nil
+		}
+		record := strings.Split(string(line), "\t")
+		for i, v := range record {
+			record[i] = tsvUnescaper.Replace(v)
+		}
+		return record, nil
+	}
+
+	d.pending = append(d.pending, line...)
+	d.quotes += bytes.Count(line, []byte{'"'})
+	if d.quotes%2 != 0 {
+		if len(d.pending) > maxCSVRecordSize {
+			d.pending, d.quotes = nil, 0
+			return nil, fmt.Errorf("unterminated quote, the record exceeds %d bytes", maxCSVRecordSize)
+		}
+		//the line break is quoted, wait for the rest of the record
+		return nil, nil
+	}
+	data := d.pending
+	d.pending, d.quotes = nil, 0
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = d.opts.comma
+	return r.Read()
+}
+
+// Finish returns an error if the file ends in a quoted value
+func (d *csvDecoder) Finish() error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	size := len(d.pending)
+	d.pending, d.quotes = nil, 0
+	return fmt.Errorf("unterminated quote at the end of file, the last %d bytes are not loaded", size)
+}
+
+func parseCSVValue(value string, typ string, arraySeparator string) (interface{}, error) {
+	if strings.HasSuffix(typ, "[]") {
+		items := []interface{}{}
+		for _, item := range strings.Split(value, arraySeparator) {
+			v, err := parseCSVValue(item, strings.TrimSuffix(typ, "[]"), arraySeparator)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	}
+
+	switch typ {
+	case "long", "integer", "short", "byte":
+		return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	case "float", "double":
+		return strconv.ParseFloat(strings.TrimSpace(value), 64)
+	case "boolean":
+		return strconv.ParseBool(strings.TrimSpace(value))
+	case "json":
+		var v interface{}
+		err := json.Unmarshal([]byte(value), &v)
+		return v, err
+	}
+	return value, nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+func TestCSVFormat(test *testing.T) {
+	doc := map[string]interface{}{"_index": "a", "_type": "doc", "_id": "1", "_source": map[string]interface{}{
+		"name": "line1\nline2, \"quoted\"",
+		"age":  float64(30),
+		"tags": []interface{}{"x", "y"},
+		"user": map[string]interface{}{"city": "berlin", "vip": true},
+	}}
+
+	encoder, err := newDumpEncoder(dumpFormatCSV, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	line, err := encoder.Encode(doc)
+	if err != nil {
+		test.Fatal(err)
+	}
+	header := encoder.(headerEncoder).Header("a")
+	if string(header) != "_id,age,name,tags,user.city,user.vip\n" {
+		test.Errorf("unexpected header %q", string(header))
+	}
+
+	config := &Config{CSVTypes: "age:long,tags:keyword[],user.vip:boolean"}
+	decoder, err := newDumpDecoder(dumpFormatCSV, config)
+	if err != nil {
+		test.Fatal(err)
+	}
+	docs := []map[string]interface{}{}
+	for _, l := range bytes.SplitAfter(append(header, line...), []byte("\n")) {
+		if len(l) == 0 {
+			continue
+		}
+		doc, err := decoder.Decode(l)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+	if len(docs) != 1 {
+		test.Fatalf("unexpected documents %v", docs)
+	}
+
+	expected := map[string]interface{}{
+		"name": "line1\nline2, \"quoted\"",
+		"age":  int64(30),
+		"tags": []interface{}{"x", "y"},
+		"user": map[string]interface{}{"city": "berlin", "vip": true},
+	}
+	if docs[0]["_id"] != "1" || !reflect.DeepEqual(docs[0]["_source"], expected) {
+		test.Errorf("unexpected document %v", docs[0])
+	}
+
+	if _, err = parseCSVTypes("age:unknown"); err == nil {
+		test.Error("unknown type accepted")
+	}
+}
+
+func TestCSVColumns(test *testing.T) {
+	newDoc := func(index string, source string) map[string]interface{} {
+		doc := map[string]interface{}{"_index": index, "_id": "1", "_source": map[string]interface{}{}}
+		doc["_source"].(map[string]interface{})[source] = "v"
+		return doc
+	}
+
+	encoder, _ := newDumpEncoder(dumpFormatCSV, &Config{DumpPerIndex: true})
+	for _, doc := range []map[string]interface{}{newDoc("a", "x"), newDoc("b", "y"), newDoc("a", "x")} {
+		if _, err := encoder.Encode(doc); err != nil {
+			test.Fatal(err)
+		}
+	}
+	if a, b := encoder.(headerEncoder).Header("a"), encoder.(headerEncoder).Header("b"); string(a) != "_id,x\n" || string(b) != "_id,y\n" {
+		test.Errorf("columns should be taken per index, got %q, %q", a, b)
+	}
+	//documents with other fields are still written with the known columns
+	if line, err := encoder.Encode(newDoc("a", "z")); err != nil || string(line) != "1,\n" {
+		test.Errorf("document with other fields should be written, got %q, %v", line, err)
+	}
+
+	//columns of mappings keep fields missing in the first document
+	encoder, _ = newDumpEncoder(dumpFormatCSV, nil)
+	encoder.(*csvEncoder).mappingColumns = []string{"user", "x", "y"}
+	lines := []byte{}
+	for _, doc := range []map[string]interface{}{newDoc("a", "x"), newDoc("a", "y"), newDoc("a", "user")} {
+		line, err := encoder.Encode(doc)
+		if err != nil {
+			test.Fatal(err)
+		}
+		lines = append(lines, line...)
+	}
+	if header := encoder.(headerEncoder).Header("a"); string(header) != "_id,user,x,y\n" || string(lines) != "1,,v,\n1,,,v\n1,v,,\n" {
+		test.Errorf("unexpected columns of mappings, got %q, %q", header, lines)
+	}
+	if !hasCSVColumn([]string{"_id", "user"}, "user.name") || hasCSVColumn([]string{"_id", "user"}, "users") {
+		test.Error("fields of object columns should be in the columns")
+	}
+
+	encoder, _ = newDumpEncoder(dumpFormatCSV, &Config{Fields: "_id,x"})
+	if line, err := encoder.Encode(newDoc("a", "z")); err != nil || string(line) != "1,\n" {
+		test.Errorf("selected columns should be written, got %q, %v", line, err)
+	}
+}
+
+func TestTSVFormat(test *testing.T) {
+	decoder, _ := newDumpDecoder(dumpFormatTSV, nil)
+	docs := []map[string]interface{}{}
+	for _, line := range []string{"_id\tname\ttitle\n", "1\t\"quoted\t5\" screen\r\n", "2\tit's \"x\tnote\n"} {
+		doc, err := decoder.Decode([]byte(line))
+		if err != nil {
+			test.Fatal(err)
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+	if len(docs) != 2 || docs[0]["_source"].(map[string]interface{})["name"] != "\"quoted" ||
+		docs[1]["_source"].(map[string]interface{})["name"] != "it's \"x" {
+		test.Fatalf("stray quotes of tsv should be kept, got %v", docs)
+	}
+
+	//values with tabs and line breaks are escaped
+	encoder, _ := newDumpEncoder(dumpFormatTSV, &Config{Fields: "_id,name"})
+	doc := map[string]interface{}{"_id": "1", "_source": map[string]interface{}{"name": "a\tb\nc\\d \"e"}}
+	line, _ := encoder.Encode(doc)
+	if string(line) != "1\ta\\tb\\nc\\\\d \"e\n" {
+		test.Errorf("unexpected tsv line %q", line)
+	}
+	decoder, _ = newDumpDecoder(dumpFormatTSV, nil)
+	decoder.Decode(encoder.(headerEncoder).Header(""))
+	decoded, err := decoder.Decode(line)
+	if err != nil || !reflect.DeepEqual(decoded["_source"], doc["_source"]) {
+		test.Errorf("unexpected document %v, %v", decoded, err)
+	}
+}
+
+func TestCSVUnterminatedQuote(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "dump.csv")
+	ioutil.WriteFile(file, []byte("_id,name\n1,\"a\n2\"\n3,\"unterminated\n4,d\n5,e\n"), 0644)
+
+	migrator := Migrator{Config: &Config{FileFormat: dumpFormatCSV}, DocChan: make(chan map[string]interface{}, 10)}
+	bar := pb.New(5)
+	bar.NotPrint = true
+	failures := migrator.readDumpChunk(dumpChunk{File: file, Start: 0, End: -1}, bar)
+	close(migrator.DocChan)
+
+	docs := 0
+	for range migrator.DocChan {
+		docs++
+	}
+	if docs != 1 || failures != 1 {
+		test.Errorf("the rest of file after an unterminated quote should be reported, got %d documents, %d failures", docs, failures)
+	}
+
+	if _, err := verifyDumpLines(file, strings.NewReader("_id,name\n1,\"x\n"), dumpFormatCSV); err == nil {
+		test.Error("unterminated quote should fail verification")
+	}
+}
@@ -16,18 +16,26 @@ limitations under the License.
 
 package main
 
-import "sync"
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
 
 type Indexes map[string]interface{}
 
 type Document struct {
 	Index  string                 `json:"_index"`
-	Type   string                 `json:"_type"`
-	Id     string                 `json:"_id"`
+	Type   string                 `json:"_type,omitempty"` //types are removed since elasticsearch 7
+	Id     string                 `json:"_id,omitempty"` //generated by elasticsearch if empty
 	source map[string]interface{} `json:"_source"`
 }
 
 type Scroll struct {
+	Bytes int `json:"-"` //size of the response
+	Slice int `json:"-"` //id of sliced scroll
 	Took int `json:"took"`
 	ScrollId string `json:"_scroll_id"`
 	TimedOut bool   `json:"timed_out"`
@@ -63,29 +71,76 @@ type ClusterHealth struct {
 	Status string `json:"status"`
 }
 
+// BulkResult is the outcome of a bulk request
+type BulkResult struct {
+	Status   int            //http status
+	Docs     int            //actions in the request
+	Failed   int            //failed actions, including rejected ones
+	Rejected int            //actions rejected by full queues with 429, kept for retrying
+	Reasons  map[string]int //failed actions by error type
+}
+
+type ThreadPoolStats struct {
+	Queue    int
+	Rejected int64
+}
+
 type Migrator struct{
 
+	DroppedDocs     int64 //documents dropped by the script, first for 64-bit alignment of atomic access
 	FlushLock       sync.Mutex
 	DocChan         chan map[string]interface{}
 	SourceESAPI     ESAPI
 	TargetESAPI     ESAPI
+	DefaultType     string //type of documents without _type, by the target version
 	SourceAuth      *Auth
 	TargetAuth      *Auth
+	SourceTLS       *tls.Config
+	TargetTLS       *tls.Config
+	SourceClient    *HTTPClient
+	TargetClient    *HTTPClient
 	Config 		*Config
+	TransformRules  []TransformRule
+	Script          *goja.Program
+	Masker          *Masker
+	DumpManifest    *DumpManifest
+	ParquetSchema   *ParquetSchema
+	CSVColumns      []string
+	ReadLimiter     *RateLimiter
+	WriteLimiter    *RateLimiter
+	BulkController  *BulkController
+	Metrics         *Metrics
 }
 
 
 type Config struct {
 
 	// config options
-	SourceEs        string `short:"s" long:"source"  description:"source elasticsearch instance, ie: http://localhost:9200"`
+	SourceEs        string `short:"s" long:"source"  description:"source elasticsearch instance, comma separated hosts of the cluster are accepted, ie: http://localhost:9200,http://localhost:9202"`
 	Query        string `short:"q" long:"query"  description:"query against source elasticsearch instance, filter data before migrate, ie: name:medcl"`
-	TargetEs        string `short:"d" long:"dest"    description:"destination elasticsearch instance, ie: http://localhost:9201"`
-	SourceEsAuthStr string `short:"m" long:"source_auth"  description:"basic auth of source elasticsearch instance, ie: user:pass"`
-	TargetEsAuthStr  string `short:"n" long:"dest_auth"  description:"basic auth of target elasticsearch instance, ie: user:pass"`
+	QueryFile    string `long:"query_file"  description:"file of query dsl against source elasticsearch instance, used verbatim as the query body, ie: q.json"`
+	QueryDSL     string `long:"query_dsl"  description:"inline query dsl against source elasticsearch instance, used as the query body"`
+	TargetEs        string `short:"d" long:"dest"    description:"destination elasticsearch instance, comma separated hosts of the cluster are accepted, ie: http://localhost:9201,http://localhost:9203"`
+	SourceEsAuthStr string `short:"m" long:"source_auth"  description:"basic auth of source elasticsearch instance, ie: user:pass, @file to read from file, also read from env ESM_SOURCE_AUTH if no auth option is set"`
+	TargetEsAuthStr  string `short:"n" long:"dest_auth"  description:"basic auth of target elasticsearch instance, ie: user:pass, @file to read from file, also read from env ESM_DEST_AUTH if no auth option is set"`
+	SourceAPIKey     string `long:"source_api_key"  description:"api key of source elasticsearch instance, id:key or the encoded key, @file to read from file, also read from env ESM_SOURCE_API_KEY if no auth option is set"`
+	TargetAPIKey     string `long:"dest_api_key"  description:"api key of target elasticsearch instance, id:key or the encoded key, @file to read from file, also read from env ESM_DEST_API_KEY if no auth option is set"`
+	SourceToken      string `long:"source_token"  description:"bearer or service account token of source elasticsearch instance, @file to read from file, also read from env ESM_SOURCE_TOKEN if no auth option is set"`
+	TargetToken      string `long:"dest_token"  description:"bearer or service account token of target elasticsearch instance, @file to read from file, also read from env ESM_DEST_TOKEN if no auth option is set"`
+	SourceAWSSigV4   bool   `long:"source_aws_sigv4"  description:"sign requests to source elasticsearch instance with aws signature v4, credentials are read from env AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or the shared credentials file"`
+	TargetAWSSigV4   bool   `long:"dest_aws_sigv4"  description:"sign requests to target elasticsearch instance with aws signature v4, credentials are read from env AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or the shared credentials file"`
+	SourceAWSRegion  string `long:"source_aws_region"  description:"aws region of source domain, read from env AWS_REGION or AWS_DEFAULT_REGION if not specified, ie: us-east-1"`
+	TargetAWSRegion  string `long:"dest_aws_region"  description:"aws region of target domain, read from env AWS_REGION or AWS_DEFAULT_REGION if not specified, ie: us-east-1"`
+	SourceAWSService string `long:"source_aws_service"  description:"aws service name of source domain to sign requests, aoss for opensearch serverless" default:"es"`
+	TargetAWSService string `long:"dest_aws_service"  description:"aws service name of target domain to sign requests, aoss for opensearch serverless" default:"es"`
+	AWSProfile       string `long:"aws_profile"  description:"profile of the shared credentials file ~/.aws/credentials, env credentials are ignored if set, read from env AWS_PROFILE if not specified"`
 	DocBufferCount    int    `short:"c" long:"count"   description:"number of documents at a time: ie \"size\" in the scroll request" default:"10000"`
 	Workers           int    `short:"w" long:"workers" description:"concurrency number for bulk workers" default:"1"`
 	BulkSizeInMB      int    `short:"b" long:"bulk_size" description:"bulk size in MB" default:"5"`
+	BulkDocs          int    `long:"bulk_docs" description:"max number of documents per bulk request, 0 for no limit"`
+	FlushInterval     time.Duration `long:"flush_interval" description:"max time documents are buffered before a bulk request is sent" default:"5s"`
+	AdaptiveBulk      bool   `long:"adaptive_bulk" description:"adjust bulk size and concurrency by latency, rejections and thread pool queue of the target, --bulk_size is the initial size and --workers the max concurrency"`
+	BulkTargetLatency time.Duration `long:"bulk_target_latency" description:"max latency of bulk requests for --adaptive_bulk, bulk size is reduced if exceeded" default:"2s"`
 	ScrollTime        string `short:"t" long:"time"    description:"scroll time" default:"1m"`
 	ScrollSliceSize   int    `long:"sliced_scroll_size"    description:"size of sliced scroll, to make it work, the size should be > 1" default:"1"`
 	RecreateIndex     bool      `short:"f" long:"force"   description:"delete destination index before copying" default:"false"`
@@ -97,16 +152,54 @@ type Config struct {
 	TargetIndexName   string `short:"y" long:"dest_index" description:"indexes name to save, allow only one indexname, original indexname will be used if not specified" default:""`
 	WaitForGreen      bool   `long:"green"             description:"wait for both hosts cluster status to be green before dump. otherwise yellow is okay"`
 	LogLevel          string `short:"v" long:"log"            description:"setting log level,options:trace,debug,info,warn,error"  default:"INFO"`
-	DumpOutFile       string  `short:"o" long:"output_file"            description:"output documents of source index into local file" `
-	DumpInputFile     string  `short:"i" long:"input_file"            description:"indexing from local dump file" `
+	DumpOutFile       string  `short:"o" long:"output_file"            description:"output documents of source index into local file, - for stdout" `
+	DumpMaxSizeInMB   int     `long:"output_max_size"            description:"roll output file into numbered parts by size in MB, size is counted before compression" `
+	DumpMaxDocs       int     `long:"output_max_docs"            description:"roll output file into numbered parts by document count" `
+	DumpPerIndex      bool    `long:"output_per_index"            description:"write one output file per source index" `
+	DumpInputFile     string  `short:"i" long:"input_file"            description:"indexing from local dump file, a directory or a glob pattern of dump files is also accepted, - for stdin" `
+	FileReaders       int     `long:"file_readers"            description:"concurrency number for reading dump files, large plain files are split into chunks, files and chunks are loaded out of order if > 1, keep 1 to load parts in order" default:"1"`
+	InputManifest     string  `long:"input_manifest"            description:"manifest of dump files, found next to input_file if not specified, used to create indexes with --copy_settings, --copy_mappings or --shards" `
+	FileFormat        string  `long:"file_format"            description:"format of dump file, options: json,bulk,csv,tsv,parquet, json is one document per line, bulk is the body of _bulk requests, an action line followed by a source line, csv and tsv have a header line of columns, parquet is output only, read from the manifest if not specified" `
+	CSVIdColumn       string  `long:"csv_id_column"            description:"column of document id when loading csv or tsv files" default:"_id"`
+	CSVTypes          string  `long:"csv_types"            description:"types of csv or tsv columns when loading, comma separated, ie: age:long,price:double,tags:keyword[], options: string,keyword,text,date,long,integer,short,byte,float,double,boolean,json, [] for arrays, string if not specified" `
+	CSVArraySeparator string  `long:"csv_array_separator"            description:"separator of array values in csv or tsv cells" default:"|"`
+	Compress          string  `long:"compress"            description:"compression of dump file, options: gzip,zstd,none, detected by file extension .gz or .zst if not specified" `
 	SourceProxy       string    `long:"source_proxy"            description:"set proxy to source http connections, ie: http://127.0.0.1:8080"`
 	TargetProxy       string    `long:"dest_proxy"            description:"set proxy to target http connections, ie: http://127.0.0.1:8080"`
+	SourceSniff       bool      `long:"source_sniff"            description:"discover nodes of source cluster by _nodes/http, requests are distributed across the nodes"`
+	TargetSniff       bool      `long:"dest_sniff"            description:"discover nodes of target cluster by _nodes/http, requests are distributed across the nodes"`
+	MaxDocsPerSec     int       `long:"max_docs_per_sec"            description:"max documents per second of scroll reads and bulk writes each, 0 for no limit, can be changed at runtime by the control endpoint"`
+	MaxBytesPerSec    int64     `long:"max_bytes_per_sec"            description:"max bytes per second of scroll reads and bulk writes each, 0 for no limit, can be changed at runtime by the control endpoint"`
+	ControlAddr       string    `long:"control_addr"            description:"listen address of the control endpoint, ie: 127.0.0.1:9700, GET /rate shows rate limits, PUT /rate?docs_per_sec=500&bytes_per_sec=1048576 changes them, GET /metrics exposes prometheus metrics"`
+	CompressRequests  bool      `long:"compress_requests"            description:"gzip bodies of bulk and search requests, and accept gzip responses, bytes saved are reported when finished"`
+	ConnectTimeout    time.Duration `long:"connect_timeout"            description:"timeout of connecting to source and target, including tls handshake" default:"10s"`
+	RequestTimeout    time.Duration `long:"request_timeout"            description:"timeout of http requests to source and target, including reading the response, stalled scroll or bulk requests fail after it, 0 for no timeout, which may block workers forever" default:"5m"`
+	MaxIdleConns      int       `long:"max_idle_conns"            description:"max idle keep-alive connections per cluster, should be no less than the number of workers" default:"100"`
+	SourceCA          string    `long:"source_ca"            description:"pem file of ca certificates to verify source https connections, ie: ca.pem"`
+	SourceCert        string    `long:"source_cert"            description:"pem file of client certificate to source https connections, used with --source_key"`
+	SourceKey         string    `long:"source_key"            description:"pem file of client private key to source https connections, used with --source_cert"`
+	TargetCA          string    `long:"dest_ca"            description:"pem file of ca certificates to verify target https connections, ie: ca.pem"`
+	TargetCert        string    `long:"dest_cert"            description:"pem file of client certificate to target https connections, used with --dest_key"`
+	TargetKey         string    `long:"dest_key"            description:"pem file of client private key to target https connections, used with --dest_cert"`
+	InsecureSkipVerify bool     `long:"insecure_skip_verify"            description:"skip verifying certificates of source and target https connections, insecure, for testing only"`
 	Refresh           bool      `long:"refresh"                 description:"refresh after migration finished"`
 	Fields            string `long:"fields"                 description:"output fields, comma separated, ie: col1,col2,col3,..." `
-
+	Sort              string `long:"sort"                   description:"sort documents of source scroll, comma separated, ie: field1:asc,field2:desc" `
+	TransformFile     string `long:"transform_file"         description:"json file of field transform rules applied to _source before output, actions: rename,remove,set,copy,move" `
+	ScriptFile        string `long:"script_file"            description:"javascript file defines function process(doc), returns null to drop the doc, an object or an array of objects" `
+	MaskFile          string `long:"mask_file"              description:"json file of field mask rules applied to _source before output, strategies: hash,redact,fake,null,regex" `
+	MaskSalt          string `long:"mask_salt"              description:"salt of hash and fake mask strategies, keep it the same across indices to keep joins working, also read from env ESM_MASK_SALT" `
+
+	// commands
+	Backup            BackupCommand  `command:"backup"  description:"backup source indexes into a single archive with settings, mappings, aliases and checksums"`
+	Restore           RestoreCommand `command:"restore" description:"restore indexes and documents from a backup archive into dest"`
+	VerifyDump        VerifyDumpCommand `command:"verify-dump" description:"verify checksums and document counts of dump files of --input_file against the manifest"`
 }
 
 type Auth struct {
-	User string
-	Pass string
+	User   string
+	Pass   string
+	APIKey string //base64 of id:key
+	Token  string //bearer or service token
+	AWS    *AWSSigner
 }
@@ -20,14 +20,18 @@ import "bytes"
 
 type ESAPI interface{
 	ClusterHealth() *ClusterHealth
-	Bulk(data *bytes.Buffer)
+	Bulk(data *bytes.Buffer) (*BulkResult, error)
+	GetThreadPoolStats() (*ThreadPoolStats, error)
 	GetIndexSettings(indexNames string) (*Indexes, error)
 	DeleteIndex(name string) (error)
 	CreateIndex(name string,settings map[string]interface{}) (error)
 	GetIndexMappings(copyAllIndexes bool,indexNames string)(string,int,*Indexes,error)
 	UpdateIndexSettings(indexName string,settings map[string]interface{})(error)
 	UpdateIndexMapping(indexName string,mappings map[string]interface{})(error)
-	NewScroll(indexNames string,scrollTime string,docBufferCount int,query string, slicedId,maxSlicedCount int, fields string)(*Scroll, error)
+	NewScroll(indexNames string,scrollTime string,docBufferCount int,query map[string]interface{}, sort []interface{}, slicedId,maxSlicedCount int, fields string)(*Scroll, error)
 	NextScroll(scrollTime string,scrollId string)(*Scroll,error)
 	Refresh(name string) (err error)
+	ValidateQuery(indexNames string,query map[string]interface{}) (error)
+	GetIndexAliases(indexNames string) (*Indexes, error)
+	UpdateIndexAliases(indexName string,aliases map[string]interface{}) (error)
 }
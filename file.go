@@ -22,8 +22,14 @@ import (
 	log "github.com/cihub/seelog"
 	"os"
 	"bufio"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 )
 
 func checkFileIsExist(filename string) (bool) {
@@ -34,61 +40,492 @@ func checkFileIsExist(filename string) (bool) {
 	return exist;
 }
 
-func (m *Migrator) NewFileReadWorker(pb *pb.ProgressBar, wg *sync.WaitGroup)  {
+// CountDumpLines returns the total number of lines of dump files
+func CountDumpLines(files []string, compress string) (int, error) {
+	lineCount := 0
+	for _, file := range files {
+		f, err := OpenDumpFile(file, compress)
+		if err != nil {
+			return 0, err
+		}
+		r := bufio.NewReader(f)
+		for{
+			line,err := r.ReadString('\n')
+			if len(line) > 0 {
+				lineCount += 1
+			}
+			if io.EOF == err || nil != err{
+				break
+			}
+		}
+		f.Close()
+	}
+	return lineCount, nil
+}
+
+// dumpChunk is a byte range of dump file, a chunk owns the lines starting
+// within [Start, End), end < 0 means reading to the end of file
+type dumpChunk struct {
+	File  string
+	Start int64
+	End   int64
+}
+
+// minDumpChunkSize avoid splitting small files into tiny chunks
+const minDumpChunkSize = 16 * 1024 * 1024
+
+// splitDumpFiles split dump files into chunks aligned to lines, compressed
+// files can't be read from the middle, so they are read as a whole
+func splitDumpFiles(files []string, compress string, readers int) ([]dumpChunk, error) {
+	chunks := []dumpChunk{}
+	for _, file := range files {
+		compression, err := getCompression(file, compress)
+		if err != nil {
+			return nil, err
+		}
+		if file == stdioFile {
+			chunks = append(chunks, dumpChunk{File: file, Start: 0, End: -1})
+			continue
+		}
+		stat, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if readers <= 1 || len(compression) > 0 || stat.Size() < 2*minDumpChunkSize {
+			chunks = append(chunks, dumpChunk{File: file, Start: 0, End: -1})
+			continue
+		}
+
+		chunkSize := stat.Size() / int64(readers)
+		if chunkSize < minDumpChunkSize {
+			chunkSize = minDumpChunkSize
+		}
+		for start := int64(0); start < stat.Size(); start += chunkSize {
+			end := start + chunkSize
+			if end >= stat.Size() {
+				end = -1
+			}
+			chunks = append(chunks, dumpChunk{File: file, Start: start, End: end})
+			if end < 0 {
+				break
+			}
+		}
+	}
+	return chunks, nil
+}
+
+// NewFileReadWorker read dump files with multiple goroutines, files and
+// byte ranges of large plain files are read concurrently
+func (m *Migrator) NewFileReadWorker(files []string, pb *pb.ProgressBar, wg *sync.WaitGroup)  {
 	log.Debug("start reading file")
-	f, err := os.Open(m.Config.DumpInputFile)
+
+	readers := m.Config.FileReaders
+	if readers < 1 {
+		readers = 1
+	}
+
+	format, err := getDumpFormat(m.Config.FileFormat)
+	if err != nil {
+		log.Error(err)
+		close(m.DocChan)
+		wg.Done()
+		return
+	}
+
+	//lines of some formats depend on previous lines, files are read as a whole
+	splitReaders := readers
+	if !dumpFormatSplittable(format) {
+		splitReaders = 1
+	}
+	chunks, err := splitDumpFiles(files, m.Config.Compress, splitReaders)
 	if err != nil {
 		log.Error(err)
+		close(m.DocChan)
+		wg.Done()
 		return
 	}
+	log.Debugf("read %d dump files in %d chunks with %d readers", len(files), len(chunks), readers)
+	if readers > 1 && len(chunks) > 1 {
+		log.Warn("dump files and chunks are loaded out of order with multiple file readers, set file_readers to 1 to load them in order")
+	}
+
+	chunkChan := make(chan dumpChunk, len(chunks))
+	for _, chunk := range chunks {
+		chunkChan <- chunk
+	}
+	close(chunkChan)
+
+	var failures int64
+	readerWg := sync.WaitGroup{}
+	readerWg.Add(readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			defer readerWg.Done()
+			for chunk := range chunkChan {
+				atomic.AddInt64(&failures, int64(m.readDumpChunk(chunk, pb)))
+			}
+		}()
+	}
+	readerWg.Wait()
+
+	if failures > 0 {
+		log.Errorf("%d lines of dump files failed to load, the dump may be truncated or corrupted", failures)
+	}
+
+	log.Debug("end reading file")
+	close(m.DocChan)
+	wg.Done()
+}
+
+// readDumpChunk returns the number of lines failed to read
+func (m *Migrator) readDumpChunk(chunk dumpChunk, pb *pb.ProgressBar) int {
+	log.Debugf("start reading file, %s [%d,%d)", chunk.File, chunk.Start, chunk.End)
+	f, err := OpenDumpFile(chunk.File, m.Config.Compress)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
 
 	defer f.Close()
+
+	offset := int64(0)
+	if chunk.Start > 0 {
+		// the line crossing the start belongs to the previous chunk, skip it
+		_, err = f.(io.Seeker).Seek(chunk.Start-1, io.SeekStart)
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		offset = chunk.Start - 1
+	}
+
 	r := bufio.NewReader(f)
+	if chunk.Start > 0 {
+		skipped, err := r.ReadString('\n')
+		if err != nil {
+			return 0
+		}
+		offset += int64(len(skipped))
+	}
+
+	//format is validated before reading
+	format, _ := getDumpFormat(m.Config.FileFormat)
+	decoder, err := newDumpDecoder(format, m.Config)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
 	lineCount := 0
-	for{
+	failures := 0
+	for chunk.End < 0 || offset < chunk.End {
+		//the last line may have no line break, it is decoded as well, truncated
+		//files fail decoding, or are found by verifying against the manifest
 		line,err := r.ReadString('\n')
-		if io.EOF == err || nil != err{
+		if io.EOF == err && len(line) == 0 {
 			break
 		}
+		if nil != err && io.EOF != err {
+			log.Errorf("failed reading file %s, offset: %d, %v", chunk.File, offset, err)
+			failures++
+			break
+		}
+		lineOffset := offset
+		offset += int64(len(line))
 		lineCount += 1
-		js := map[string]interface{}{}
 
 		//log.Trace("reading file,",lineCount,",", line)
-		err = json.Unmarshal([]byte(line), &js)
+		js, err := decoder.Decode([]byte(line))
 		if(err!=nil){
-			log.Error(err)
+			log.Errorf("failed decoding line of file %s, offset: %d, %v", chunk.File, lineOffset, err)
+			failures++
+			continue
+		}
+		if js == nil {
 			continue
 		}
 		m.DocChan <- js
 		pb.Increment()
+		m.Metrics.ReadDocs("file", "", 1, len(line))
+	}
+	if f, ok := decoder.(finishDecoder); ok && chunk.End < 0 {
+		if err := f.Finish(); err != nil {
+			log.Errorf("failed decoding file %s, %v", chunk.File, err)
+			failures++
+		}
 	}
+	return failures
+}
 
-	defer f.Close()
-	log.Debug("end reading file")
-	close(m.DocChan)
-	wg.Done()
+// DumpWriter write documents into dump file, it rolls output into numbered
+// parts by size or doc count, and writes one file per index if asked, eg:
+// dump.json.gz => dump.00001.json.gz, dump.myindex.00001.json.gz
+type DumpWriter struct {
+	File     string
+	Compress string
+	MaxSize  int64
+	MaxDocs  int
+	PerIndex bool
+	// Truncate overwrite existing files instead of appending, so that files
+	// are covered by the manifest from the beginning
+	Truncate bool
+	// Header returns the line written at the beginning of new files
+	Header func(index string) []byte
+	// Wrap returns the writer of documents of a new file, for formats with
+	// a file layout, eg: parquet
+	Wrap func(w io.Writer) (io.WriteCloser, error)
+
+	parts  map[string]*dumpPart
+	counts map[string]int
+	files  []DumpFileInfo
 }
 
-func (c *Migrator) NewFileDumpWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
-	var f *os.File
-	var err1   error;
+type dumpPart struct {
+	file   string
+	index  string
+	number int
+	f      io.WriteCloser
+	w      *bufio.Writer
+	out    io.Writer
+	size   int64
+	docs   int
+}
+
+func (d *DumpWriter) rolling() bool {
+	return d.MaxSize > 0 || d.MaxDocs > 0
+}
+
+// partFileName insert index name and part number before the extensions
+func (d *DumpWriter) partFileName(index string, number int) string {
+	if !d.PerIndex && !d.rolling() {
+		return d.File
+	}
+
+	base, ext := d.File, ""
+	for _, compressExt := range []string{".gz", ".zst"} {
+		if strings.HasSuffix(base, compressExt) {
+			base, ext = strings.TrimSuffix(base, compressExt), compressExt
+			break
+		}
+	}
+	if e := filepath.Ext(base); len(e) > 0 {
+		base, ext = strings.TrimSuffix(base, e), e+ext
+	}
+
+	if d.PerIndex {
+		base = base + "." + index
+	}
+	if d.rolling() {
+		base = fmt.Sprintf("%s.%05d", base, number)
+	}
+	return base + ext
+}
+
+func (d *DumpWriter) openPart(index string, number int) (*dumpPart, error) {
+	file := d.partFileName(index, number)
+	exists := file != stdioFile && checkFileIsExist(file)
+	if exists && d.Truncate {
+		log.Warnf("dump file %s exists, it is overwritten", file)
+		exists = false
+	}
+	f, err := CreateDumpFile(file, d.Compress, d.Truncate)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("start writing dump file, ", file)
+	part := &dumpPart{file: file, index: index, number: number, f: f, w: bufio.NewWriter(f)}
+	part.out = part.w
+	if d.Wrap != nil {
+		if part.out, err = d.Wrap(part.w); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if d.Header != nil && !exists {
+		n, err := part.w.Write(d.Header(index))
+		part.size += int64(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return part, nil
+}
+
+func (d *DumpWriter) closePart(p *dumpPart) error {
+	var err error
+	if wrapped, ok := p.out.(io.WriteCloser); ok {
+		err = wrapped.Close()
+	}
+	if e := p.w.Flush(); e != nil && err == nil {
+		err = e
+	}
+	if e := p.f.Close(); e != nil && err == nil {
+		err = e
+	}
+	info := DumpFileInfo{Name: filepath.Base(p.file), Index: p.index, Docs: p.docs}
+	if err == nil && p.file != stdioFile {
+		info.SHA256, err = fileSHA256(p.file)
+	}
+	d.files = append(d.files, info)
+	return err
+}
+
+// Write append one line of document to the dump file of the index
+func (d *DumpWriter) Write(index string, line []byte) error {
+	if d.parts == nil {
+		d.parts = map[string]*dumpPart{}
+		d.counts = map[string]int{}
+	}
+	d.counts[index]++
+	if !d.PerIndex {
+		index = ""
+	}
+
+	part, ok := d.parts[index]
+	if ok && ((d.MaxSize > 0 && part.size+int64(len(line)) > d.MaxSize && part.docs > 0) || (d.MaxDocs > 0 && part.docs >= d.MaxDocs)) {
+		if err := d.closePart(part); err != nil {
+			return err
+		}
+		next, err := d.openPart(index, part.number+1)
+		if err != nil {
+			return err
+		}
+		d.parts[index], part = next, next
+	} else if !ok {
+		next, err := d.openPart(index, 1)
+		if err != nil {
+			return err
+		}
+		d.parts[index], part = next, next
+	}
+
+	n, err := part.out.Write(line)
+	part.size += int64(n)
+	part.docs++
+	return err
+}
+
+func (d *DumpWriter) Close() error {
+	var err error
+	for _, part := range d.parts {
+		if e := d.closePart(part); e != nil && err == nil {
+			err = e
+		}
+	}
+	d.parts = nil
+	sort.Slice(d.files, func(i, j int) bool { return d.files[i].Name < d.files[j].Name })
+	return err
+}
+
+// Counts returns the number of documents written of each index
+func (d *DumpWriter) Counts() map[string]int {
+	return d.counts
+}
+
+// Files returns the dump files written, available after closed
+func (d *DumpWriter) Files() []DumpFileInfo {
+	return d.files
+}
+
+// ListDumpFiles returns dump files to load, input can be a file, a directory,
+// a glob pattern or the output file of a rolled dump, files are sorted by
+// name, so numbered parts are loaded in order, "-" is stdin
+func ListDumpFiles(input string) ([]string, error) {
+	files := []string{}
+
+	if input == stdioFile {
+		return []string{stdioFile}, nil
+	}
 
-	if checkFileIsExist(c.Config.DumpOutFile) {
-		f, err1 = os.OpenFile(c.Config.DumpOutFile, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
-		if(err1!=nil){
-			log.Error(err1)
-			return
+	if stat, err := os.Stat(input); err == nil {
+		if !stat.IsDir() {
+			return []string{input}, nil
+		}
+		infos, err := ioutil.ReadDir(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.IsDir() || strings.HasPrefix(info.Name(), ".") || strings.HasSuffix(info.Name(), dumpManifestSuffix) {
+				continue
+			}
+			files = append(files, filepath.Join(input, info.Name()))
+		}
+	} else if checkFileIsExist(input + dumpManifestSuffix) {
+		//output file rolled into parts, load parts listed in the manifest
+		manifest, err := LoadDumpManifest(input + dumpManifestSuffix)
+		if err != nil {
+			return nil, err
 		}
+		for _, info := range manifest.Files {
+			files = append(files, filepath.Join(filepath.Dir(input), info.Name))
+		}
+	} else {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if !strings.HasSuffix(match, dumpManifestSuffix) {
+				files = append(files, match)
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no dump file found: " + input)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (c *Migrator) NewFileDumpWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
+	w := &DumpWriter{
+		File:     c.Config.DumpOutFile,
+		Compress: c.Config.Compress,
+		MaxSize:  int64(c.Config.DumpMaxSizeInMB) * 1000000,
+		MaxDocs:  c.Config.DumpMaxDocs,
+		PerIndex: c.Config.DumpPerIndex,
+		//the manifest only knows documents of this run
+		Truncate: c.DumpManifest != nil,
+	}
 
-	}else {
-		f, err1 = os.Create(c.Config.DumpOutFile)
-		if(err1!=nil){
-			log.Error(err1)
-			return
+	format, err := getDumpFormat(c.Config.FileFormat)
+	if err != nil {
+		log.Error(err)
+		wg.Done()
+		return
+	}
+	var encoder dumpEncoder
+	if format == dumpFormatParquet {
+		//compression is done inside parquet files, which can't be appended
+		w.Compress = "none"
+		w.Truncate = true
+		encoder, err = newParquetEncoder(c.ParquetSchema, c.Config.Compress)
+	} else {
+		encoder, err = newDumpEncoder(format, c.Config)
+		if e, ok := encoder.(*csvEncoder); ok {
+			e.mappingColumns = c.CSVColumns
 		}
 	}
+	if err != nil {
+		log.Error(err)
+		wg.Done()
+		return
+	}
+	if h, ok := encoder.(headerEncoder); ok {
+		w.Header = h.Header
+	}
+	if wrapper, ok := encoder.(wrapEncoder); ok {
+		w.Wrap = wrapper.Wrap
+	}
 
-	w := bufio.NewWriter(f)
+	transformer, err := c.NewDocTransformer()
+	if err != nil {
+		log.Error(err)
+		wg.Done()
+		return
+	}
 
 	READ_DOCS:
 	for {
@@ -111,16 +548,33 @@ func (c *Migrator) NewFileDumpWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
 			}
 		}
 
-		jsr,err:=json.Marshal(docI)
-		log.Trace(string(jsr))
-		if(err!=nil){
-			log.Error(err)
+		docs, err := transformer.Transform(docI)
+		if err != nil {
+			log.Error("failed transforming document: ", err)
+			continue
 		}
-		n,err:=w.WriteString(string(jsr))
-		if(err!=nil){
-			log.Error(n,err)
+		// dropped by the script, counted so that totals match the source
+		if len(docs) == 0 {
+			atomic.AddInt64(&c.DroppedDocs, 1)
+			pb.Increment()
+			continue
+		}
+
+		for _, doc := range docs {
+			jsr,err:=encoder.Encode(doc)
+			log.Trace(string(jsr))
+			if(err!=nil){
+				log.Error(err)
+				continue
+			}
+			index, _ := doc["_index"].(string)
+			err=w.Write(index, jsr)
+			if(err!=nil){
+				log.Error(err)
+				continue
+			}
+			c.Metrics.WriteDocs("file", 1, len(jsr))
 		}
-		w.WriteString("\n")
 		pb.Increment()
 
 		// if channel is closed flush and gtfo
@@ -130,11 +584,18 @@ func (c *Migrator) NewFileDumpWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
 	}
 
 	WORKER_DONE:
-	w.Flush()
-	f.Close()
+	if err := w.Close(); err != nil {
+		log.Error(err)
+	}
+
+	if c.DumpManifest != nil {
+		c.DumpManifest.FileFormat = format
+		c.DumpManifest.SetDumpResult(w.Counts(), w.Files())
+		if err := c.DumpManifest.Write(c.Config.DumpOutFile + dumpManifestSuffix); err != nil {
+			log.Error(err)
+		}
+	}
 
 	wg.Done()
 	log.Debug("file dump finished")
 }
-
-
@@ -0,0 +1,151 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+func TestRollingDumpWriter(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+
+	w := &DumpWriter{File: filepath.Join(dir, "dump.json.gz"), MaxDocs: 2, PerIndex: true}
+	for i := 0; i < 5; i++ {
+		if err := w.Write("a", []byte("{}\n")); err != nil {
+			test.Fatal(err)
+		}
+	}
+	w.Write("b", []byte("{}\n"))
+	if err := w.Close(); err != nil {
+		test.Fatal(err)
+	}
+
+	manifest := &DumpManifest{Indices: map[string]*DumpIndexManifest{"a": {}}}
+	manifest.SetDumpResult(w.Counts(), w.Files())
+	if err := manifest.Write(filepath.Join(dir, "dump.json.gz"+dumpManifestSuffix)); err != nil {
+		test.Fatal(err)
+	}
+	if FindDumpManifest(dir) == "" || manifest.Indices["a"].DocCount != 5 || manifest.Indices["b"].DocCount != 1 || len(manifest.Files) != 4 {
+		test.Errorf("unexpected manifest: %+v", manifest)
+	}
+
+	files, err := ListDumpFiles(dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := []string{"dump.a.00001.json.gz", "dump.a.00002.json.gz", "dump.a.00003.json.gz", "dump.b.00001.json.gz"}
+	if len(files) != len(expected) {
+		test.Fatalf("unexpected files: %v", files)
+	}
+	for i, file := range files {
+		if filepath.Base(file) != expected[i] {
+			test.Errorf("unexpected file %s, expected %s", file, expected[i])
+		}
+	}
+
+	lines, err := CountDumpLines(files, "")
+	if err != nil || lines != 6 {
+		test.Errorf("unexpected line count %d, %v", lines, err)
+	}
+
+	files, err = ListDumpFiles(filepath.Join(dir, "dump.a.*"))
+	if err != nil || len(files) != 3 {
+		test.Errorf("unexpected glob result %v, %v", files, err)
+	}
+
+	files, err = ListDumpFiles("-")
+	if err != nil || len(files) != 1 || files[0] != stdioFile {
+		test.Errorf("unexpected stdin result %v, %v", files, err)
+	}
+}
+
+func TestReadDumpChunks(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "dump.json")
+
+	content := ""
+	for i := 0; i < 100; i++ {
+		content += fmt.Sprintf("{\"_id\":\"%d\",\"_source\":{\"padding\":\"%s\"}}\n", i, strings.Repeat("x", i%7))
+	}
+	ioutil.WriteFile(file, []byte(content), 0644)
+
+	migrator := Migrator{Config: &Config{}, DocChan: make(chan map[string]interface{}, 200)}
+	bar := pb.New(100)
+
+	//split at arbitrary offsets, every line should be read exactly once
+	chunkSize := int64(97)
+	for start := int64(0); start < int64(len(content)); start += chunkSize {
+		end := start + chunkSize
+		if end >= int64(len(content)) {
+			end = -1
+		}
+		migrator.readDumpChunk(dumpChunk{File: file, Start: start, End: end}, bar)
+	}
+	close(migrator.DocChan)
+
+	ids := map[string]int{}
+	for doc := range migrator.DocChan {
+		ids[doc["_id"].(string)]++
+	}
+	if len(ids) != 100 {
+		test.Errorf("expected 100 documents, got %d", len(ids))
+	}
+	for id, count := range ids {
+		if count != 1 {
+			test.Errorf("document %s read %d times", id, count)
+		}
+	}
+}
+
+func TestReadLastLineWithoutLineBreak(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+
+	for format, content := range map[string]string{
+		dumpFormatJSON: "{\"_id\":\"1\",\"_index\":\"a\",\"_type\":\"doc\",\"_source\":{}}\n{\"_id\":\"2\",\"_index\":\"a\",\"_type\":\"doc\",\"_source\":{}}",
+		dumpFormatBulk: "{\"index\":{\"_index\":\"a\",\"_id\":\"1\"}}\n{}\n{\"index\":{\"_index\":\"a\",\"_id\":\"2\"}}\n{}",
+		dumpFormatCSV:  "_id,name\n1,x\n2,y",
+	} {
+		file := filepath.Join(dir, "dump."+format)
+		ioutil.WriteFile(file, []byte(content), 0644)
+
+		migrator := Migrator{Config: &Config{FileFormat: format}, DocChan: make(chan map[string]interface{}, 10)}
+		bar := pb.New(2)
+		bar.NotPrint = true
+		failures := migrator.readDumpChunk(dumpChunk{File: file, Start: 0, End: -1}, bar)
+		close(migrator.DocChan)
+		ids := []string{}
+		for doc := range migrator.DocChan {
+			ids = append(ids, doc["_id"].(string))
+		}
+		if failures != 0 || fmt.Sprint(ids) != "[1 2]" {
+			test.Errorf("last line of %s without line break should be loaded, got %v, %d failures", format, ids, failures)
+		}
+		if lines, _ := CountDumpLines([]string{file}, ""); lines != strings.Count(content, "\n")+1 {
+			test.Errorf("last line of %s without line break should be counted, got %d", format, lines)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// formats of dump file:
+//   json  one document per line, eg: {"_id":"1","_index":"a","_source":{},"_type":"doc"}
+//   bulk  _bulk request body, an action line followed by a source line
+//   csv   a header line of columns and a line per document
+//   tsv   the same as csv, separated by tabs
+//   parquet  apache parquet with schema derived from index mappings, output only
+const (
+	dumpFormatJSON    = "json"
+	dumpFormatBulk    = "bulk"
+	dumpFormatCSV     = "csv"
+	dumpFormatTSV     = "tsv"
+	dumpFormatParquet = "parquet"
+)
+
+func getDumpFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", dumpFormatJSON:
+		return dumpFormatJSON, nil
+	case dumpFormatBulk, dumpFormatCSV, dumpFormatTSV, dumpFormatParquet:
+		return strings.ToLower(format), nil
+	}
+	return "", errors.New("unsupported file format: " + format + ", options: json,bulk,csv,tsv,parquet")
+}
+
+// dumpEncoder encode a document into lines of dump file
+type dumpEncoder interface {
+	Encode(doc map[string]interface{}) ([]byte, error)
+}
+
+// dumpDecoder decode lines of dump file into documents, a nil document is
+// returned if the line doesn't complete a document
+type dumpDecoder interface {
+	Decode(line []byte) (map[string]interface{}, error)
+}
+
+// finishDecoder is implemented by decoders buffering lines of a document,
+// Finish returns an error if the file ends in the middle of a document
+type finishDecoder interface {
+	Finish() error
+}
+
+// headerEncoder is implemented by encoders writing a header line at the
+// beginning of files, index is the index of the first document of the file
+type headerEncoder interface {
+	Header(index string) []byte
+}
+
+// wrapEncoder is implemented by encoders of formats with a file layout, the
+// encoded documents are written by the wrapping writer
+type wrapEncoder interface {
+	Wrap(w io.Writer) (io.WriteCloser, error)
+}
+
+// newDumpEncoder returns the encoder of format, options of the format are
+// read from the config
+func newDumpEncoder(format string, c *Config) (dumpEncoder, error) {
+	switch format {
+	case dumpFormatBulk:
+		return bulkEncoder{}, nil
+	case dumpFormatCSV, dumpFormatTSV:
+		opts, err := newCSVOptions(format, c)
+		if err != nil {
+			return nil, err
+		}
+		return &csvEncoder{opts: opts}, nil
+	case dumpFormatParquet:
+		return nil, errors.New("parquet encoder is created with the schema of index mappings")
+	}
+	return jsonEncoder{}, nil
+}
+
+// newDumpDecoder returns the decoder of format, a decoder reads one file from
+// the beginning, default options are used if the config is nil
+func newDumpDecoder(format string, c *Config) (dumpDecoder, error) {
+	switch format {
+	case dumpFormatBulk:
+		return &bulkDecoder{}, nil
+	case dumpFormatCSV, dumpFormatTSV:
+		opts, err := newCSVOptions(format, c)
+		if err != nil {
+			return nil, err
+		}
+		return &csvDecoder{opts: opts}, nil
+	case dumpFormatParquet:
+		return nil, errors.New("loading parquet files is not supported")
+	}
+	return jsonDecoder{}, nil
+}
+
+// splittable formats can be read from the middle of file
+func dumpFormatSplittable(format string) bool {
+	return format == dumpFormatJSON
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(doc map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(line []byte) (map[string]interface{}, error) {
+	doc := map[string]interface{}{}
+	err := json.Unmarshal(line, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+type bulkEncoder struct{}
+
+func (bulkEncoder) Encode(doc map[string]interface{}) ([]byte, error) {
+	meta := map[string]interface{}{}
+	for _, key := range []string{"_index", "_type", "_id"} {
+		if v, ok := doc[key]; ok && v != "" {
+			meta[key] = v
+		}
+	}
+	action, err := json.Marshal(map[string]interface{}{"index": meta})
+	if err != nil {
+		return nil, err
+	}
+	source, err := json.Marshal(doc["_source"])
+	if err != nil {
+		return nil, err
+	}
+	data := append(action, '\n')
+	data = append(data, source...)
+	return append(data, '\n'), nil
+}
+
+// bulkDecoder pair action and source lines, index, create and update with a
+// partial doc are loaded as documents, delete actions are skipped
+type bulkDecoder struct {
+	op   string
+	meta map[string]interface{}
+}
+
+func (d *bulkDecoder) Decode(line []byte) (map[string]interface{}, error) {
+	if d.meta == nil {
+		action := map[string]interface{}{}
+		err := json.Unmarshal(line, &action)
+		if err != nil {
+			return nil, err
+		}
+		if len(action) != 1 {
+			return nil, fmt.Errorf("invalid bulk action: %s", strings.TrimSpace(string(line)))
+		}
+		for op, v := range action {
+			meta, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid bulk action: %s", strings.TrimSpace(string(line)))
+			}
+			switch op {
+			case "index", "create", "update":
+				d.op, d.meta = op, meta
+			case "delete":
+				//no source line follows
+			default:
+				return nil, errors.New("unsupported bulk action: " + op)
+			}
+		}
+		return nil, nil
+	}
+
+	op, meta := d.op, d.meta
+	d.meta = nil
+
+	source := map[string]interface{}{}
+	err := json.Unmarshal(line, &source)
+	if err != nil {
+		return nil, err
+	}
+	if op == "update" {
+		partial, ok := source["doc"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("only update actions with doc are supported")
+		}
+		source = partial
+	}
+
+	//actions without _type, eg: bulk files of elasticsearch 7+, are given the
+	//default type of the target when loaded
+	doc := map[string]interface{}{"_index": "", "_type": "", "_id": "", "_source": source}
+	for _, key := range []string{"_index", "_type", "_id"} {
+		if v, ok := meta[key]; ok {
+			doc[key] = v
+		}
+	}
+	return doc, nil
+}
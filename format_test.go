@@ -0,0 +1,68 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBulkFormat(test *testing.T) {
+	doc := map[string]interface{}{"_index": "a", "_type": "doc", "_id": "1", "_source": map[string]interface{}{"f": "v"}}
+	encoder, _ := newDumpEncoder(dumpFormatBulk, nil)
+	data, err := encoder.Encode(doc)
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := "{\"index\":{\"_id\":\"1\",\"_index\":\"a\",\"_type\":\"doc\"}}\n{\"f\":\"v\"}\n"
+	if string(data) != expected {
+		test.Errorf("unexpected bulk lines %q", string(data))
+	}
+
+	input := string(data) +
+		"{\"delete\":{\"_index\":\"a\",\"_id\":\"2\"}}\n" +
+		"{\"update\":{\"_index\":\"b\",\"_id\":\"3\"}}\n{\"doc\":{\"f\":\"u\"}}\n"
+	decoder, _ := newDumpDecoder(dumpFormatBulk, nil)
+	docs := []map[string]interface{}{}
+	for _, line := range bytes.SplitAfter([]byte(input), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		doc, err := decoder.Decode(line)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+
+	if len(docs) != 2 {
+		test.Fatalf("unexpected documents %v", docs)
+	}
+	if docs[0]["_id"] != "1" || docs[0]["_type"] != "doc" || docs[0]["_source"].(map[string]interface{})["f"] != "v" {
+		test.Errorf("unexpected document %v", docs[0])
+	}
+	if docs[1]["_index"] != "b" || docs[1]["_type"] != "" || docs[1]["_source"].(map[string]interface{})["f"] != "u" {
+		test.Errorf("unexpected document %v", docs[1])
+	}
+
+	decoder, _ = newDumpDecoder(dumpFormatBulk, nil)
+	if _, err = decoder.Decode([]byte("{\"index\":{},\"create\":{}}\n")); err == nil {
+		test.Error("invalid action accepted")
+	}
+}
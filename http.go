@@ -17,138 +17,282 @@ limitations under the License.
 package main
 
 import (
-	"net/http"
-	"github.com/parnurzeal/gorequest"
-	log "github.com/cihub/seelog"
-	"io/ioutil"
-	"io"
-	"errors"
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
 )
 
-func Get(url string,auth *Auth,proxy string) (*http.Response, string, []error) {
-	request := gorequest.New()
-	if(auth!=nil){
-		request.SetBasicAuth(auth.User,auth.Pass)
-	}
+// HTTPClient is the long-lived client of a cluster, connections are pooled
+// and kept alive across requests, shared by all workers
+type HTTPClient struct {
+	Client   *http.Client
+	Auth     *Auth
+	Nodes    *NodePool
+	Compress bool //gzip bulk and search request bodies, and accept gzip responses
+	Stats    *HTTPStats
+}
 
-	request.Header["Content-Type"]= "application/json"
-	
-	if(len(proxy)>0){
-		request.Proxy(proxy)
-	}
+// HTTPStats counts bytes of compressed requests and responses, before and
+// after compression, allocated alone for 64-bit alignment of atomic counters
+type HTTPStats struct {
+	RequestBytes      int64
+	RequestGzipBytes  int64
+	ResponseBytes     int64
+	ResponseGzipBytes int64
+}
 
-	resp, body, errs := request.Get(url).End()
-	return resp, body, errs
+func (s *HTTPStats) String() string {
+	ratio := func(raw, gzipped int64) string {
+		if gzipped == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1fx", float64(raw)/float64(gzipped))
+	}
+	requestBytes, requestGzipBytes := atomic.LoadInt64(&s.RequestBytes), atomic.LoadInt64(&s.RequestGzipBytes)
+	responseBytes, responseGzipBytes := atomic.LoadInt64(&s.ResponseBytes), atomic.LoadInt64(&s.ResponseGzipBytes)
+	return fmt.Sprintf("requests compressed %s to %s (%s), responses compressed %s to %s (%s)",
+		formatBytes(requestBytes), formatBytes(requestGzipBytes), ratio(requestBytes, requestGzipBytes),
+		formatBytes(responseBytes), formatBytes(responseGzipBytes), ratio(responseBytes, responseGzipBytes))
+}
 
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	v, i := float64(n), 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.2f %s", v, units[i])
 }
 
-func Post(url string,auth *Auth, body string,proxy string)(*http.Response, string, []error)  {
-	request := gorequest.New()
-	if(auth!=nil){
-		request.SetBasicAuth(auth.User,auth.Pass)
+// NewHTTPClient returns the client of a cluster, requests are distributed
+// across hosts, timeouts and pool size are read from the config, default
+// options are used if the config is nil
+func NewHTTPClient(hosts []string, auth *Auth, proxy string, tlsConfig *tls.Config, c *Config) (*HTTPClient, error) {
+	connectTimeout, requestTimeout, maxIdleConns := 10*time.Second, 5*time.Minute, 100
+	if c != nil {
+		connectTimeout, requestTimeout, maxIdleConns = c.ConnectTimeout, c.RequestTimeout, c.MaxIdleConns
 	}
 
-	request.Header["Content-Type"]= "application/json"
-	
-	if(len(proxy)>0){
-		request.Proxy(proxy)
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: connectTimeout,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if len(proxy) > 0 {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
 	}
 
-	request.Post(url)
+	client := &HTTPClient{
+		Client: &http.Client{Transport: transport, Timeout: requestTimeout},
+		Auth:   auth,
+		Stats:  &HTTPStats{},
+	}
+	if c != nil {
+		client.Compress = c.CompressRequests
+	}
+	if len(hosts) > 0 {
+		client.Nodes = NewNodePool(hosts)
+	}
+	return client, nil
+}
 
-	if(len(body)>0){
-		request.Send(body)
+func (c *HTTPClient) Get(url string) (*http.Response, string, []error) {
+	resp, body, err := c.do("GET", url, nil)
+	if err != nil {
+		return resp, string(body), []error{err}
 	}
+	return resp, string(body), nil
+}
 
-	return request.End()
+func (c *HTTPClient) Post(url string, body string) (*http.Response, string, []error) {
+	resp, respBody, err := c.do("POST", url, []byte(body))
+	if err != nil {
+		return resp, string(respBody), []error{err}
+	}
+	return resp, string(respBody), nil
 }
 
-func newDeleteRequest(client *http.Client,method, urlStr string) (*http.Request, error) {
-	if method == "" {
-		// We document that "" means "GET" for Request.Method, and people have
-		// relied on that from NewRequest, so keep that working.
-		// We still enforce validMethod for non-empty methods.
-		method = "GET"
+func (c *HTTPClient) Request(method string, r string, body *bytes.Buffer) (string, error) {
+	var data []byte
+	if body != nil {
+		data = body.Bytes()
 	}
-	u, err := url.Parse(urlStr)
+
+	resp, respBody, err := c.do(method, r, data)
 	if err != nil {
-		return nil, err
+		log.Error(err)
+		return "", err
 	}
-	req := &http.Request{
-		Method:     method,
-		URL:        u,
-		Proto:      "HTTP/1.1",
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header:     make(http.Header),
-		Host:       u.Host,
+
+	if resp.StatusCode != 200 {
+		return "", errors.New("server error: " + string(respBody))
 	}
-	return req, nil
-}
 
-func Request(method string,r string,auth *Auth,body *bytes.Buffer,proxy string)(string,error)  {
+	log.Trace(r, string(respBody))
+
+	return string(respBody), nil
+}
 
-	var client *http.Client
-	//client = &http.Client{}
-	transport := http.Transport{
-		DisableKeepAlives: true,
+// do send the request to the next live node, and retry on other nodes if the
+// node is unreachable or unavailable, requests which may have been applied,
+// like bulk, are only retried if the connection failed
+func (c *HTTPClient) do(method string, r string, body []byte) (*http.Response, []byte, error) {
+	body, gzipped, err := c.encodeBody(r, body)
+	if err != nil {
+		return nil, nil, err
 	}
-	client = &http.Client{
-		Transport: &transport,
+
+	if c.Nodes == nil {
+		return c.send(method, r, body, gzipped)
 	}
-	if(len(proxy)>0){
-		proxyURL, err := url.Parse(proxy)
-		if(err!=nil){
-			log.Error(err)
-		}else{
-			transport := &http.Transport{
-				DisableKeepAlives: true,
-				Proxy: http.ProxyURL(proxyURL),
-			}
-			client = &http.Client{Transport: transport}
+
+	var resp *http.Response
+	var respBody []byte
+	for i := 0; i < c.Nodes.Size(); i++ {
+		node := c.Nodes.Next()
+		resp, respBody, err = c.send(method, c.Nodes.Rewrite(r, node), body, gzipped)
+		if err == nil && !nodeUnavailable(resp.StatusCode) {
+			c.Nodes.MarkAlive(node)
+			return resp, respBody, nil
+		}
+		if err != nil {
+			c.Nodes.MarkDead(node, err)
+		} else {
+			c.Nodes.MarkDead(node, errors.New(resp.Status))
+		}
+		if !idempotent(method) && !requestNotSent(err) {
+			break
 		}
 	}
+	return resp, respBody, err
+}
 
+// idempotent requests can be sent again without side effects
+func idempotent(method string) bool {
+	return method == "GET" || method == "HEAD"
+}
 
-	var reqest *http.Request
-	if(body!=nil){
-		reqest, _ =http.NewRequest(method,r,body)
-	}else{
-		reqest, _ = newDeleteRequest(client,method,r)
-	}
-	if(auth!=nil){
-		reqest.SetBasicAuth(auth.User,auth.Pass)
-	}
+// requestNotSent returns true if the node can't be connected, so the
+// request never reached it
+func requestNotSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
 
-	reqest.Header.Set("Content-Type", "application/json")
+// nodeUnavailable returns true if the status means the node can't serve
+// requests, eg: behind a proxy while restarting
+func nodeUnavailable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
 
+// bodies smaller than this are sent as they are, gzip doesn't make them smaller
+const minGzipBodySize = 1024
 
-	resp,errs := client.Do(reqest)
-	if errs != nil {
-		log.Error(errs)
-		return "",errs
+// encodeBody gzip bodies of bulk and search requests if compression is
+// enabled, they are large and compress well
+func (c *HTTPClient) encodeBody(r string, body []byte) ([]byte, bool, error) {
+	if !c.Compress || len(body) < minGzipBodySize {
+		return body, false, nil
 	}
-
-	if resp.StatusCode != 200 {
-		b, _ := ioutil.ReadAll(resp.Body)
-		return "",errors.New("server error: "+string(b))
+	u, err := url.Parse(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if !strings.HasSuffix(u.Path, "/_bulk") && !strings.Contains(u.Path, "/_search") {
+		return body, false, nil
 	}
 
-	respBody,err:=ioutil.ReadAll(resp.Body)
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	if _, err = w.Write(body); err != nil {
+		return nil, false, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, false, err
+	}
+	atomic.AddInt64(&c.Stats.RequestBytes, int64(len(body)))
+	atomic.AddInt64(&c.Stats.RequestGzipBytes, int64(buf.Len()))
+	return buf.Bytes(), true, nil
+}
 
+// send the request and read the response body, the body of the returned
+// response can still be read, requests are signed if auth is aws
+func (c *HTTPClient) send(method string, r string, body []byte, gzipped bool) (*http.Response, []byte, error) {
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, r, reader)
 	if err != nil {
-		log.Error(err)
-		return string(respBody),err
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.Compress {
+		//decompressed here instead of the transport, to count the bytes
+		req.Header.Set("Accept-Encoding", "gzip")
 	}
 
-	log.Trace(r,string(respBody))
+	if c.Auth != nil {
+		if c.Auth.AWS != nil {
+			c.Auth.AWS.Sign(req, body, time.Now())
+		} else {
+			req.Header.Set("Authorization", c.Auth.Authorization())
+		}
+	}
 
+	resp, err := c.Client.Do(req)
 	if err != nil {
-		return string(respBody),err
+		return nil, nil, err
 	}
-	io.Copy(ioutil.Discard, resp.Body)
 	defer resp.Body.Close()
-	return string(respBody),nil
+
+	//the body is read to the end, to reuse the connection
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
+		gzipBytes := len(respBody)
+		respBody, err = gunzip(respBody)
+		resp.Header.Del("Content-Encoding")
+		atomic.AddInt64(&c.Stats.ResponseBytes, int64(len(respBody)))
+		atomic.AddInt64(&c.Stats.ResponseGzipBytes, int64(gzipBytes))
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	return resp, respBody, err
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
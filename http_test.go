@@ -0,0 +1,105 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPClientKeepAlive(test *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("{}"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client, _ := NewHTTPClient(nil, nil, "", nil, nil)
+	for i := 0; i < 5; i++ {
+		client.Get(server.URL)
+		client.Post(server.URL, "{}")
+		client.Request("PUT", server.URL, bytes.NewBufferString("{}"))
+	}
+	if atomic.LoadInt32(&conns) != 1 {
+		test.Fatal("connection should be reused, new connections:", conns)
+	}
+
+	client, _ = NewHTTPClient(nil, nil, "", nil, &Config{ConnectTimeout: time.Second, RequestTimeout: 50 * time.Millisecond, MaxIdleConns: 1})
+	if _, _, errs := client.Get(server.URL + "/slow"); errs == nil {
+		test.Fatal("request should time out")
+	}
+}
+
+func TestHTTPClientCompress(test *testing.T) {
+	body := bytes.Repeat([]byte("{\"index\":{\"_index\":\"a\"}}\n{\"name\":\"medcl\"}\n"), 100)
+	errs := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		gzipped := r.Header.Get("Content-Encoding") == "gzip"
+		if gzipped {
+			data, _ = gunzip(data)
+		}
+		if gzipped != (r.URL.Path != "/idx" && len(data) >= minGzipBodySize) || (len(data) > 2 && !bytes.Equal(data, body)) {
+			errs = append(errs, r.URL.Path)
+		}
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			gw.Write(bytes.Repeat([]byte("{}"), 100))
+			gw.Close()
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client, _ := NewHTTPClient(nil, nil, "", nil, &Config{ConnectTimeout: time.Second, MaxIdleConns: 1, CompressRequests: true})
+	resp, _ := client.Request("POST", server.URL+"/_bulk", bytes.NewBuffer(body))
+	client.Post(server.URL+"/idx/_search?scroll=1m", string(body))
+	client.Request("PUT", server.URL+"/idx", bytes.NewBuffer(body))
+	client.Post(server.URL+"/idx/_search", "{}")
+	if len(errs) > 0 {
+		test.Fatal("unexpected request bodies", errs)
+	}
+	if resp != strings.Repeat("{}", 100) {
+		test.Fatal("gzip response should be decompressed", resp)
+	}
+	stats := client.Stats
+	if stats.RequestBytes != int64(2*len(body)) || stats.RequestGzipBytes == 0 || stats.RequestGzipBytes > stats.RequestBytes/5 {
+		test.Fatal("unexpected request stats", stats.String())
+	}
+	if stats.ResponseBytes != 800 || stats.ResponseGzipBytes == 0 {
+		test.Fatal("unexpected response stats", stats.String())
+	}
+}
@@ -17,11 +17,36 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"os"
 	"strings"
 	log "github.com/cihub/seelog"
 )
 
-func setInitLogging(logLevel string) {
+// stderrReceiver write logs to stderr, used when stdout is the dump output
+type stderrReceiver struct{}
+
+func (r *stderrReceiver) ReceiveMessage(message string, level log.LogLevel, context log.LogContextInterface) error {
+	_, err := fmt.Fprint(os.Stderr, message)
+	return err
+}
+
+func (r *stderrReceiver) AfterParse(initArgs log.CustomReceiverInitArgs) error {
+	return nil
+}
+
+func (r *stderrReceiver) Flush() {
+}
+
+func (r *stderrReceiver) Close() error {
+	return nil
+}
+
+func init() {
+	log.RegisterReceiver("stderr", &stderrReceiver{})
+}
+
+func setInitLogging(logLevel string, stderr bool) {
 
 	logLevel = strings.ToLower(logLevel)
 
@@ -33,7 +58,7 @@ func setInitLogging(logLevel string) {
 			<filter levels="error">
 				<file path="./log/gopa.log"/>
 			</filter>
-			<console formatid="main" />
+			`+consoleOutput(stderr)+`
 		</outputs>
 		<formats>
 			<format id="main" format="[%Date(01-02) %Time] [%LEV] [%File:%Line,%FuncShort] %Msg%n"/>
@@ -49,3 +74,10 @@ func setInitLogging(logLevel string) {
 		log.Error("init config error,", err)
 	}
 }
+
+func consoleOutput(stderr bool) string {
+	if stderr {
+		return `<custom name="stderr" formatid="main" />`
+	}
+	return `<console formatid="main" />`
+}
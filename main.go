@@ -6,14 +6,14 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"bufio"
 	log "github.com/cihub/seelog"
 	goflags "github.com/jessevdk/go-flags"
 	pb "gopkg.in/cheggaaa/pb.v1"
 	"os"
-	"io"
+	"path/filepath"
 )
 
 func main() {
@@ -26,13 +26,41 @@ func main() {
 
 
 	// parse args
-	_, err := goflags.Parse(c)
+	parser := goflags.NewParser(c, goflags.Default)
+	parser.SubcommandsOptional = true
+	_, err := parser.Parse()
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	setInitLogging(c.LogLevel)
+	//keep stdout clean for documents when writing to stdout
+	setInitLogging(c.LogLevel, c.DumpOutFile == stdioFile)
+
+	//backup and restore are built on dump and load with a temporary directory
+	var command, workDir string
+	if parser.Active != nil {
+		command = parser.Active.Name
+		switch command {
+		case "backup":
+			workDir, err = c.Backup.Prepare(c)
+		case "restore":
+			workDir, err = c.Restore.Prepare(c)
+		case "verify-dump":
+			err = c.VerifyDump.Run(c)
+			if err != nil {
+				log.Error(err)
+			}
+			return
+		}
+		if len(workDir) > 0 {
+			defer os.RemoveAll(workDir)
+		}
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
 
 	if len(c.SourceEs) == 0 && len(c.DumpInputFile) == 0 {
 		log.Error("no input, type --help for more details")
@@ -43,15 +71,85 @@ func main() {
 		return
 	}
 
+	if c.DumpOutFile == stdioFile && (c.DumpMaxSizeInMB > 0 || c.DumpMaxDocs > 0 || c.DumpPerIndex) {
+		log.Error("output_max_size, output_max_docs and output_per_index can't be used when writing to stdout")
+		return
+	}
+
+	if c.FlushInterval <= 0 || c.BulkDocs < 0 {
+		log.Error("flush_interval should be > 0 and bulk_docs should be >= 0")
+		return
+	}
+
+	if format, err := getDumpFormat(c.FileFormat); err != nil {
+		log.Error(err)
+		return
+	} else if format == dumpFormatParquet && (len(c.SourceEs) == 0 || len(c.DumpOutFile) == 0) {
+		log.Error("parquet format is only supported when dumping source indexes into files")
+		return
+	}
+	if _, err = parseCSVTypes(c.CSVTypes); err != nil {
+		log.Error(err)
+		return
+	}
+
 	if c.SourceEs == c.TargetEs && c.SourceIndexNames == c.TargetIndexName {
 		log.Error("migration output is the same as the output")
 		return
 	}
 
+	if len(c.TransformFile) > 0 {
+		migrator.TransformRules, err = LoadTransformRules(c.TransformFile)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+
+	if len(c.ScriptFile) > 0 {
+		migrator.Script, err = CompileScript(c.ScriptFile)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		//make sure the script is runnable before migration starts
+		if _, err = NewScriptRuntime(migrator.Script); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+
+	if len(c.MaskFile) > 0 {
+		salt := c.MaskSalt
+		if len(salt) == 0 {
+			salt = os.Getenv("ESM_MASK_SALT")
+		}
+		migrator.Masker, err = LoadMasker(c.MaskFile, salt)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+
 	// enough of a buffer to hold all the search results across all workers
 	migrator.DocChan = make(chan map[string]interface{}, c.DocBufferCount*c.Workers*10)
 
+	// rate limits of scroll readers and bulk workers, adjustable by the control endpoint
+	migrator.ReadLimiter = NewRateLimiter(c.MaxDocsPerSec, c.MaxBytesPerSec)
+	migrator.WriteLimiter = NewRateLimiter(c.MaxDocsPerSec, c.MaxBytesPerSec)
+	if c.AdaptiveBulk && len(c.TargetEs) > 0 {
+		migrator.BulkController = NewBulkController(c.BulkSizeInMB*1000000, c.Workers, c.BulkTargetLatency)
+	}
+	if len(c.ControlAddr) > 0 {
+		migrator.Metrics = NewMetrics()
+		if err = migrator.StartControlServer(c.ControlAddr); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+
 	var srcESVersion *ClusterVersion
+	var dumpManifest *DumpManifest
 	// create a progressbar and start a docCount
 	var outputBar *pb.ProgressBar
 	var fetchBar = pb.New(1).Prefix("Scroll")
@@ -60,54 +158,130 @@ func main() {
 
 	//dealing with input
 	if len(c.SourceEs) > 0 {
-		//dealing with basic auth
-		if len(c.SourceEsAuthStr) > 0 && strings.Contains(c.SourceEsAuthStr, ":") {
-			authArray := strings.Split(c.SourceEsAuthStr, ":")
-			auth := Auth{User: authArray[0], Pass: authArray[1]}
-			migrator.SourceAuth = &auth
+		//dealing with auth
+		migrator.SourceAuth, err = loadAuth(c.SourceEsAuthStr, c.SourceAPIKey, c.SourceToken, "ESM_SOURCE")
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		if c.SourceAWSSigV4 {
+			migrator.SourceAuth, err = newAWSAuth(migrator.SourceAuth, c.SourceAWSRegion, c.SourceAWSService, c.AWSProfile)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+		}
+
+		//dealing with tls
+		migrator.SourceTLS, err = NewTLSConfig(c.SourceCA, c.SourceCert, c.SourceKey, c.InsecureSkipVerify)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
+		sourceHosts, err := ParseHosts(c.SourceEs)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		migrator.SourceClient, err = NewHTTPClient(sourceHosts, migrator.SourceAuth, migrator.Config.SourceProxy, migrator.SourceTLS, c)
+		if err != nil {
+			log.Error(err)
+			return
 		}
 
 		//get source es version
-		srcESVersion, errs := migrator.ClusterVersion(c.SourceEs, migrator.SourceAuth,migrator.Config.SourceProxy)
+		srcESVersion, errs := migrator.ClusterVersion(sourceHosts[0], migrator.SourceClient)
 		if errs != nil {
 			return
 		}
+		if c.SourceSniff {
+			if err = migrator.SourceClient.Sniff(); err != nil {
+				log.Warn("failed to sniff nodes, use the hosts instead, ", err)
+			}
+		}
 		if strings.HasPrefix(srcESVersion.Version.Number, "6.") {
 			log.Debug("source es is V6,", srcESVersion.Version.Number)
 			api := new(ESAPIV5)
-			api.Host = c.SourceEs
-			api.Auth = migrator.SourceAuth
-			api.HttpProxy=migrator.Config.SourceProxy
+			api.Host = sourceHosts[0]
+			api.Client = migrator.SourceClient
 			migrator.SourceESAPI = api
 		} else if strings.HasPrefix(srcESVersion.Version.Number, "5.") {
 			log.Debug("source es is V5,", srcESVersion.Version.Number)
 			api := new(ESAPIV5)
-			api.Host = c.SourceEs
-			api.Auth = migrator.SourceAuth
-			api.HttpProxy=migrator.Config.SourceProxy
+			api.Host = sourceHosts[0]
+			api.Client = migrator.SourceClient
 			migrator.SourceESAPI = api
 		} else {
 			log.Debug("source es is not V5,", srcESVersion.Version.Number)
 			api := new(ESAPIV0)
-			api.Host = c.SourceEs
-			api.Auth = migrator.SourceAuth
-			api.HttpProxy=migrator.Config.SourceProxy
+			api.Host = sourceHosts[0]
+			api.Client = migrator.SourceClient
 			migrator.SourceESAPI = api
 		}
 
+		query, err := BuildScrollQuery(c)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		if query != nil {
+			err = migrator.SourceESAPI.ValidateQuery(c.SourceIndexNames, query)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+		}
+
+		sort, err := BuildScrollSort(c.Sort)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
 		if(c.ScrollSliceSize<1){c.ScrollSliceSize=1}
 
+		if sort != nil && c.ScrollSliceSize > 1 && len(c.DumpOutFile) > 0 {
+			log.Warn("documents are only sorted within each slice when sliced scroll is used, set sliced_scroll_size to 1 to keep the dump file in order")
+		}
+
+		//save settings, mappings and aliases next to the dump
+		if len(c.DumpOutFile) > 0 && c.DumpOutFile != stdioFile {
+			migrator.DumpManifest, err = migrator.NewDumpManifest(srcESVersion)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+		}
+
+		if format, _ := getDumpFormat(c.FileFormat); format == dumpFormatParquet {
+			migrator.ParquetSchema, err = migrator.NewParquetSchema()
+			if err != nil {
+				log.Error(err)
+				return
+			}
+		} else if (format == dumpFormatCSV || format == dumpFormatTSV) && len(c.Fields) == 0 {
+			//columns of mappings keep fields missing in the first documents
+			schema, err := migrator.NewParquetSchema()
+			if err != nil {
+				log.Warn("failed to get index mappings, csv columns are taken from the first document, ", err)
+			} else {
+				migrator.CSVColumns = schema.Columns()
+			}
+		}
+
 		fetchBar.ShowBar=false
 
 		totalSize:=0;
 		finishedSlice:=0
 		for slice:=0;slice<c.ScrollSliceSize ;slice++  {
-			scroll, err := migrator.SourceESAPI.NewScroll(c.SourceIndexNames, c.ScrollTime, c.DocBufferCount, c.Query,slice,c.ScrollSliceSize, c.Fields)
+			scroll, err := migrator.SourceESAPI.NewScroll(c.SourceIndexNames, c.ScrollTime, c.DocBufferCount, query, sort,slice,c.ScrollSliceSize, c.Fields)
 			if err != nil {
 				log.Error(err)
 				return
 			}
 			totalSize+=scroll.Hits.Total
+			scroll.Slice=slice
 
 			if scroll != nil && scroll.Hits.Docs != nil {
 
@@ -151,74 +325,141 @@ func main() {
 	} else if len(c.DumpInputFile) > 0 {
 		//read file stream
 		wg.Add(1)
-		f, err := os.Open(c.DumpInputFile)
+		files, err := ListDumpFiles(c.DumpInputFile)
 		if err != nil {
 			log.Error(err)
 			return
 		}
-		//get file lines
-		lineCount := 0
-		defer f.Close()
-		r := bufio.NewReader(f)
-		for{
-			_,err := r.ReadString('\n')
-			if io.EOF == err || nil != err{
-				break
+		log.Debug("dump files,", files)
+
+		manifestFile := c.InputManifest
+		if len(manifestFile) == 0 && c.DumpInputFile != stdioFile {
+			manifestFile = FindDumpManifest(c.DumpInputFile)
+		}
+		if len(manifestFile) > 0 {
+			dumpManifest, err = LoadDumpManifest(manifestFile)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			log.Debug("dump manifest,", manifestFile)
+			if len(c.FileFormat) == 0 {
+				c.FileFormat = dumpManifest.FileFormat
 			}
-			lineCount += 1
+		}
+		//get file lines, verify files if the manifest exists, stdin can only
+		//be read once, so the total is unknown
+		var lineCount int
+		if c.DumpInputFile == stdioFile {
+			if dumpManifest != nil {
+				lineCount = dumpManifest.TotalDocs()
+			}
+		} else if dumpManifest != nil {
+			lineCount, err = VerifyDumpFiles(files, dumpManifest, filepath.Dir(manifestFile), c.Compress)
+		} else {
+			lineCount, err = CountDumpLines(files, c.Compress)
+			switch format, _ := getDumpFormat(c.FileFormat); format {
+			case dumpFormatBulk:
+				//an action line and a source line per document, roughly
+				lineCount = lineCount / 2
+			case dumpFormatCSV, dumpFormatTSV:
+				lineCount = lineCount - len(files)
+			}
+		}
+		if err != nil {
+			log.Error(err)
+			return
 		}
 		log.Trace("file line,", lineCount)
-		fetchBar := pb.New(lineCount).Prefix("Read")
+		fetchBar = pb.New(lineCount).Prefix("Read")
 		outputBar = pb.New(lineCount).Prefix("Output ")
-		f.Close()
+		if lineCount == 0 {
+			for _, bar := range []*pb.ProgressBar{fetchBar, outputBar} {
+				bar.ShowPercent = false
+				bar.ShowTimeLeft = false
+			}
+		}
 
-		go migrator.NewFileReadWorker(fetchBar,&wg)
+		go migrator.NewFileReadWorker(files, fetchBar,&wg)
 	}
 
 	// start pool
-	pool, err := pb.StartPool(fetchBar, outputBar)
+	pool := pb.NewPool(fetchBar, outputBar)
+	if c.DumpInputFile == stdioFile || c.DumpOutFile == stdioFile {
+		pool.Output = os.Stderr
+	}
+	err = pool.Start()
 	if err != nil {
 		panic(err)
 	}
 
 	//dealing with output
 	if len(c.TargetEs) > 0 {
-		if len(c.TargetEsAuthStr) > 0 && strings.Contains(c.TargetEsAuthStr, ":") {
-			authArray := strings.Split(c.TargetEsAuthStr, ":")
-			auth := Auth{User: authArray[0], Pass: authArray[1]}
-			migrator.TargetAuth = &auth
+		migrator.TargetAuth, err = loadAuth(c.TargetEsAuthStr, c.TargetAPIKey, c.TargetToken, "ESM_DEST")
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		if c.TargetAWSSigV4 {
+			migrator.TargetAuth, err = newAWSAuth(migrator.TargetAuth, c.TargetAWSRegion, c.TargetAWSService, c.AWSProfile)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+		}
+
+		//dealing with tls
+		migrator.TargetTLS, err = NewTLSConfig(c.TargetCA, c.TargetCert, c.TargetKey, c.InsecureSkipVerify)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
+		targetHosts, err := ParseHosts(c.TargetEs)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		migrator.TargetClient, err = NewHTTPClient(targetHosts, migrator.TargetAuth, migrator.Config.TargetProxy, migrator.TargetTLS, c)
+		if err != nil {
+			log.Error(err)
+			return
 		}
 
 		//get target es version
-		descESVersion, errs := migrator.ClusterVersion(c.TargetEs, migrator.TargetAuth,migrator.Config.TargetProxy)
+		descESVersion, errs := migrator.ClusterVersion(targetHosts[0], migrator.TargetClient)
 		if errs != nil {
 			return
 		}
+		if c.TargetSniff {
+			if err = migrator.TargetClient.Sniff(); err != nil {
+				log.Warn("failed to sniff nodes, use the hosts instead, ", err)
+			}
+		}
 
 		if strings.HasPrefix(descESVersion.Version.Number, "6.") {
 			log.Debug("target es is V6,", descESVersion.Version.Number)
 			api := new(ESAPIV5)
-			api.Host = c.TargetEs
-			api.Auth = migrator.TargetAuth
-			api.HttpProxy=migrator.Config.TargetProxy
+			api.Host = targetHosts[0]
+			api.Client = migrator.TargetClient
 			migrator.TargetESAPI = api
 		}else if strings.HasPrefix(descESVersion.Version.Number, "5.") {
 			log.Debug("target es is V5,", descESVersion.Version.Number)
 			api := new(ESAPIV5)
-			api.Host = c.TargetEs
-			api.Auth = migrator.TargetAuth
-			api.HttpProxy=migrator.Config.TargetProxy
+			api.Host = targetHosts[0]
+			api.Client = migrator.TargetClient
 			migrator.TargetESAPI = api
 		} else {
 			log.Debug("target es is not V5,", descESVersion.Version.Number)
 			api := new(ESAPIV0)
-			api.Host = c.TargetEs
-			api.Auth = migrator.TargetAuth
-			api.HttpProxy=migrator.Config.TargetProxy
+			api.Host = targetHosts[0]
+			api.Client = migrator.TargetClient
 			migrator.TargetESAPI = api
 
 		}
 
+		migrator.DefaultType = defaultDocType(descESVersion.Version.Number)
+
 		log.Debug("start process with mappings")
 		if srcESVersion != nil && c.CopyIndexMappings && descESVersion.Version.Number[0] != srcESVersion.Version.Number[0] {
 			log.Error(srcESVersion.Version, "=>", descESVersion.Version, ",cross-big-version mapping migration not avaiable, please update mapping manually :(")
@@ -391,9 +632,27 @@ func main() {
 			}
 
 			defer migrator.recoveryIndexSettings(sourceIndexRefreshSettings)
-		} else if len(c.DumpInputFile) > 0 {
-			//check shard settings
-			//TODO support shard config
+		} else if len(c.DumpInputFile) > 0 && dumpManifest != nil {
+			if c.CopyIndexMappings && len(dumpManifest.SourceVersion) > 0 && descESVersion.Version.Number[0] != dumpManifest.SourceVersion[0] {
+				if command != "restore" {
+					log.Error(dumpManifest.SourceVersion, "=>", descESVersion.Version, ",cross-big-version mapping migration not avaiable, please update mapping manually :(")
+					return
+				}
+				//restore into any version, let the target create mappings dynamically
+				log.Warn(dumpManifest.SourceVersion, "=>", descESVersion.Version.Number, ",cross-big-version mapping migration not avaiable, mappings are skipped, please update mapping manually")
+				c.CopyIndexMappings = false
+			}
+
+			if c.CopyIndexSettings || c.CopyIndexMappings || c.ShardsCount > 0 {
+				log.Info("start settings/mappings restoring from manifest..")
+				dumpIndexRefreshSettings, err := migrator.RestoreIndexes(dumpManifest)
+				defer migrator.recoveryIndexSettings(dumpIndexRefreshSettings)
+				if err != nil {
+					log.Error(err)
+					return
+				}
+				log.Info("settings/mappings restoring finished.")
+			}
 		}
 
 	}
@@ -405,6 +664,10 @@ func main() {
 		log.Debug("start es bulk workers")
 		outputBar.Prefix("Bulk")
 		var docCount int
+		if migrator.BulkController != nil {
+			migrator.BulkController.Start(migrator.TargetESAPI)
+			defer migrator.BulkController.Stop()
+		}
 		wg.Add(c.Workers)
 		for i := 0; i < c.Workers; i++ {
 			go migrator.NewBulkWorker(&docCount, outputBar, &wg)
@@ -422,6 +685,25 @@ func main() {
 	pool.Stop()
 
 	log.Info("data migration finished.")
+	if dropped := atomic.LoadInt64(&migrator.DroppedDocs); dropped > 0 {
+		log.Infof("%d documents dropped by script", dropped)
+	}
+
+	if c.CompressRequests {
+		if migrator.SourceClient != nil {
+			log.Info("source ", migrator.SourceClient.Stats.String())
+		}
+		if migrator.TargetClient != nil {
+			log.Info("target ", migrator.TargetClient.Stats.String())
+		}
+	}
+
+	if command == "backup" {
+		err = c.Backup.Finish(c, workDir)
+		if err != nil {
+			log.Error(err)
+		}
+	}
 }
 
 func (c *Migrator) recoveryIndexSettings(sourceIndexRefreshSettings map[string]interface{}) {
@@ -437,10 +719,10 @@ func (c *Migrator) recoveryIndexSettings(sourceIndexRefreshSettings map[string]i
 	}
 }
 
-func (c *Migrator) ClusterVersion(host string, auth *Auth,proxy string) (*ClusterVersion, []error) {
+func (c *Migrator) ClusterVersion(host string, client *HTTPClient) (*ClusterVersion, []error) {
 
 	url := fmt.Sprintf("%s", host)
-	_, body, errs := Get(url, auth,proxy)
+	_, body, errs := client.Get(url)
 	if errs != nil {
 		log.Error(errs)
 		return nil, errs
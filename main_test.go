@@ -26,7 +26,7 @@ import
 
 
 func TestParse(test *testing.T){
-	setInitLogging("debug")
+	setInitLogging("debug", false)
 
 	text:= `{ "_scroll_id": "c2NhbjswOzE7dG90YWxfaGl0czoxODY1MjY5Ow==", "took": 1, "timed_out": false, "_shards": { "total": 1, "successful": 0, "failed": 1, "failures": [ { "shard": -1, "index": null } ] }, "hits": { "total": 1865269, "max_score": 0, "hits": [] } }`
 	scroll := Scroll{}
@@ -0,0 +1,227 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// the manifest is written next to the dump file, eg: dump.json.gz.manifest.json
+const dumpManifestSuffix = ".manifest.json"
+
+// DumpManifest describes a dump, so that it can be restored to a fresh cluster
+type DumpManifest struct {
+	SourceVersion string                        `json:"source_version"`
+	CreatedAt     time.Time                     `json:"created_at"`
+	FileFormat    string                        `json:"file_format,omitempty"`
+	Indices       map[string]*DumpIndexManifest `json:"indices"`
+	Files         []DumpFileInfo                `json:"files"`
+}
+
+type DumpIndexManifest struct {
+	Settings map[string]interface{} `json:"settings"`
+	Mappings map[string]interface{} `json:"mappings"`
+	Aliases  map[string]interface{} `json:"aliases"`
+	DocCount int                    `json:"doc_count"`
+}
+
+type DumpFileInfo struct {
+	Name   string `json:"name"`
+	Index  string `json:"index,omitempty"`
+	Docs   int    `json:"docs"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewDumpManifest collect settings, mappings and aliases of source indexes
+func (c *Migrator) NewDumpManifest(version *ClusterVersion) (*DumpManifest, error) {
+	indexNames, _, mappings, err := c.SourceESAPI.GetIndexMappings(c.Config.CopyAllIndexes, c.Config.SourceIndexNames)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexNames) == 0 {
+		return nil, errors.New("index not exists, " + c.Config.SourceIndexNames)
+	}
+
+	settings, err := c.SourceESAPI.GetIndexSettings(indexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := c.SourceESAPI.GetIndexAliases(indexNames)
+	if err != nil {
+		//aliases are optional
+		log.Warn("failed to get index aliases, ", err)
+		aliases = &Indexes{}
+	}
+
+	manifest := &DumpManifest{
+		SourceVersion: version.Version.Number,
+		CreatedAt:     time.Now(),
+		Indices:       map[string]*DumpIndexManifest{},
+	}
+
+	for _, name := range strings.Split(indexNames, ",") {
+		idx := &DumpIndexManifest{}
+		if v, ok := (*settings)[name].(map[string]interface{}); ok {
+			idx.Settings, _ = v["settings"].(map[string]interface{})
+		}
+		if v, ok := (*mappings)[name].(map[string]interface{}); ok {
+			idx.Mappings, _ = v["mappings"].(map[string]interface{})
+		}
+		if v, ok := (*aliases)[name].(map[string]interface{}); ok {
+			idx.Aliases, _ = v["aliases"].(map[string]interface{})
+		}
+		manifest.Indices[name] = idx
+	}
+
+	return manifest, nil
+}
+
+// SetDumpResult record documents count of indexes and files of the dump
+func (d *DumpManifest) SetDumpResult(counts map[string]int, files []DumpFileInfo) {
+	for name, count := range counts {
+		idx, ok := d.Indices[name]
+		if !ok {
+			//index renamed or created by transforms
+			idx = &DumpIndexManifest{}
+			d.Indices[name] = idx
+		}
+		idx.DocCount = count
+	}
+	d.Files = files
+}
+
+// TotalDocs returns the number of documents of all dump files
+func (d *DumpManifest) TotalDocs() int {
+	total := 0
+	for _, info := range d.Files {
+		total += info.Docs
+	}
+	return total
+}
+
+func (d *DumpManifest) Write(file string) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Debug("write dump manifest, ", file)
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func LoadDumpManifest(file string) (*DumpManifest, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &DumpManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// FindDumpManifest returns the manifest of dump input, input is a file or a
+// directory with only one manifest, empty if not found
+func FindDumpManifest(input string) string {
+	if checkFileIsExist(input + dumpManifestSuffix) {
+		return input + dumpManifestSuffix
+	}
+
+	if stat, err := os.Stat(input); err == nil && stat.IsDir() {
+		matches, _ := filepath.Glob(filepath.Join(input, "*"+dumpManifestSuffix))
+		if len(matches) == 1 {
+			return matches[0]
+		}
+		if len(matches) > 1 {
+			log.Warn("more than one manifest found in ", input, ", use --input_manifest to choose one")
+		}
+	}
+	return ""
+}
+
+// RestoreIndexes create indexes in target from the manifest, returns the
+// refresh settings to recover after loading finished
+func (c *Migrator) RestoreIndexes(manifest *DumpManifest) (map[string]interface{}, error) {
+	refreshSettings := map[string]interface{}{}
+
+	indexes := manifest.Indices
+	//if there is only one index and we specify the dest indexname
+	if len(c.Config.TargetIndexName) > 0 && len(indexes) == 1 {
+		for name, idx := range indexes {
+			indexes = map[string]*DumpIndexManifest{c.Config.TargetIndexName: idx}
+			log.Debugf("only one index,so we can rewrite indexname, src:%v, dest:%v", name, c.Config.TargetIndexName)
+		}
+	}
+
+	for name, idx := range indexes {
+		if c.Config.RecreateIndex {
+			c.TargetESAPI.DeleteIndex(name)
+		} else if _, err := c.TargetESAPI.GetIndexSettings(name); err == nil {
+			log.Infof("index %s already exists, skip creating", name)
+			continue
+		}
+
+		tempIndexSettings := getEmptyIndexSettings()
+		if c.Config.CopyIndexSettings && idx.Settings != nil {
+			tempIndexSettings["settings"] = copyValue(idx.Settings)
+			if _, ok := tempIndexSettings["settings"].(map[string]interface{})["index"]; !ok {
+				tempIndexSettings["settings"].(map[string]interface{})["index"] = map[string]interface{}{}
+			}
+		}
+		indexSettings := tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})
+
+		refreshSettings[name] = indexSettings["refresh_interval"]
+		indexSettings["refresh_interval"] = -1
+
+		//override shard settings
+		if c.Config.ShardsCount > 0 {
+			indexSettings["number_of_shards"] = c.Config.ShardsCount
+		}
+
+		log.Debug("create index with settings,", name, tempIndexSettings)
+		err := c.TargetESAPI.CreateIndex(name, tempIndexSettings)
+		if err != nil {
+			return refreshSettings, err
+		}
+
+		if c.Config.CopyIndexMappings && len(idx.Mappings) > 0 {
+			err = c.TargetESAPI.UpdateIndexMapping(name, idx.Mappings)
+			if err != nil {
+				return refreshSettings, err
+			}
+		}
+
+		if c.Config.CopyIndexSettings && len(idx.Aliases) > 0 {
+			err = c.TargetESAPI.UpdateIndexAliases(name, idx.Aliases)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	return refreshSettings, nil
+}
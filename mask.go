@@ -0,0 +1,265 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"unicode"
+
+	log "github.com/cihub/seelog"
+)
+
+// MaskRule is one entry of the mask rule file, eg:
+// [{"field":"user.email","strategy":"hash"},
+//  {"field":"phone","strategy":"fake"},
+//  {"field":"name","strategy":"redact","value":"***"},
+//  {"field":"ssn","strategy":"null"},
+//  {"field":"comment","strategy":"regex","pattern":"\\d{3}-\\d{4}","replacement":"xxx-xxxx"}]
+// field is a dotted path relative to _source, arrays are masked element by element
+type MaskRule struct {
+	Field       string `json:"field"`
+	Strategy    string `json:"strategy"`
+	Value       string `json:"value"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+
+	regex *regexp.Regexp
+}
+
+// Masker is safe to be shared by workers
+type Masker struct {
+	rules []MaskRule
+	salt  []byte
+}
+
+func LoadMasker(file string, salt string) (*Masker, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []MaskRule{}
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if len(rule.Field) == 0 {
+			return nil, fmt.Errorf("mask rule %d: field is required", i)
+		}
+		switch rule.Strategy {
+		case "hash", "fake":
+			if len(salt) == 0 {
+				log.Warnf("mask rule %d: no salt provided, %s of field %s can be reversed by brute force", i, rule.Strategy, rule.Field)
+			}
+		case "redact":
+			if len(rule.Value) == 0 {
+				rule.Value = "***"
+			}
+		case "regex":
+			rule.regex, err = regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("mask rule %d: %v", i, err)
+			}
+		case "null":
+		default:
+			return nil, errors.New("unknown mask strategy: " + rule.Strategy)
+		}
+	}
+
+	log.Debugf("loaded %d mask rules from %s", len(rules), file)
+	return &Masker{rules: rules, salt: []byte(salt)}, nil
+}
+
+// Mask apply rules to document source in place
+func (m *Masker) Mask(source map[string]interface{}) {
+	for i := range m.rules {
+		rule := &m.rules[i]
+		v, ok := getFieldByPath(source, rule.Field)
+		if !ok {
+			continue
+		}
+		if rule.Strategy == "null" {
+			setFieldByPath(source, rule.Field, nil)
+			continue
+		}
+		setFieldByPath(source, rule.Field, m.maskValue(rule, v))
+	}
+}
+
+func (m *Masker) maskValue(rule *MaskRule, v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, item := range t {
+			a[i] = m.maskValue(rule, item)
+		}
+		return a
+	case map[string]interface{}:
+		//objects can't be masked partly, hash or redact the whole value
+		b, _ := json.Marshal(t)
+		v = string(b)
+	case bool, float64, float32, int, int64, int32:
+		return m.maskScalar(rule, v)
+	}
+
+	str, isString := v.(string)
+	if !isString {
+		str = fmt.Sprint(v)
+	}
+
+	switch rule.Strategy {
+	case "hash":
+		return m.hash(str)
+	case "redact":
+		return rule.Value
+	case "regex":
+		return rule.regex.ReplaceAllString(str, rule.Replacement)
+	case "fake":
+		return m.fake(str)
+	}
+	return v
+}
+
+// maskScalar keep the json type of numbers and booleans, so that masked
+// values still fit numeric and boolean mappings, numbers are hashed into
+// non-negative 31-bit numbers to fit integer fields, redacted values are
+// null, as the value of the rule is a string
+func (m *Masker) maskScalar(rule *MaskRule, v interface{}) interface{} {
+	var str string
+	switch n := v.(type) {
+	case float64:
+		//no exponent, so that only digits are faked
+		str = strconv.FormatFloat(n, 'f', -1, 64)
+	case float32:
+		str = strconv.FormatFloat(float64(n), 'f', -1, 32)
+	default:
+		str = fmt.Sprint(v)
+	}
+
+	switch rule.Strategy {
+	case "hash":
+		mac := hmac.New(sha256.New, m.salt)
+		mac.Write([]byte(str))
+		sum := binary.BigEndian.Uint32(mac.Sum(nil)) >> 1
+		if _, isBool := v.(bool); isBool {
+			return sum%2 == 1
+		}
+		str = strconv.FormatUint(uint64(sum), 10)
+	case "fake":
+		if _, isBool := v.(bool); isBool {
+			return m.fake(str)[0]%2 == 1
+		}
+		str = m.fake(str)
+	case "regex":
+		str = rule.regex.ReplaceAllString(str, rule.Replacement)
+	default:
+		return nil
+	}
+	return parseScalarAs(v, str)
+}
+
+// parseScalarAs parse str as the type of v, nil if it is not valid
+func parseScalarAs(v interface{}, str string) interface{} {
+	var parsed interface{}
+	var err error
+	switch v.(type) {
+	case bool:
+		parsed, err = strconv.ParseBool(str)
+	case float64:
+		parsed, err = strconv.ParseFloat(str, 64)
+	case float32:
+		var f float64
+		f, err = strconv.ParseFloat(str, 32)
+		parsed = float32(f)
+	case int:
+		var i int64
+		i, err = strconv.ParseInt(str, 10, 0)
+		parsed = int(i)
+	case int64:
+		parsed, err = strconv.ParseInt(str, 10, 64)
+	case int32:
+		var i int64
+		i, err = strconv.ParseInt(str, 10, 32)
+		parsed = int32(i)
+	}
+	if err != nil {
+		return nil
+	}
+	return parsed
+}
+
+// hash is deterministic for the same salt, so joins across indices still work
+func (m *Masker) hash(str string) string {
+	mac := hmac.New(sha256.New, m.salt)
+	mac.Write([]byte(str))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// fake replace digits with digits and letters with letters of the same case,
+// other characters like @ . - are kept, so the format of emails and phone
+// numbers is preserved, the output is deterministic for the same salt
+func (m *Masker) fake(str string) string {
+	mac := hmac.New(sha256.New, m.salt)
+	mac.Write([]byte(str))
+	seed := mac.Sum(nil)
+
+	var stream []byte
+	counter := uint32(0)
+	next := func() byte {
+		if len(stream) == 0 {
+			block := hmac.New(sha256.New, seed)
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, counter)
+			block.Write(b)
+			stream = block.Sum(nil)
+			counter++
+		}
+		r := stream[0]
+		stream = stream[1:]
+		return r
+	}
+
+	out := []rune(str)
+	for i, r := range out {
+		switch {
+		case r >= '0' && r <= '9':
+			out[i] = rune('0' + next()%10)
+		case r >= 'a' && r <= 'z':
+			out[i] = rune('a' + next()%26)
+		case r >= 'A' && r <= 'Z':
+			out[i] = rune('A' + next()%26)
+		case unicode.IsLetter(r):
+			//no way to keep the format of other languages, use latin letters
+			out[i] = rune('a' + next()%26)
+		}
+	}
+	return string(out)
+}
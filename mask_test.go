@@ -0,0 +1,100 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestMask(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mask.json")
+	ioutil.WriteFile(file, []byte(`[
+		{"field":"user.email","strategy":"hash"},
+		{"field":"phone","strategy":"fake"},
+		{"field":"mobile","strategy":"fake"},
+		{"field":"age","strategy":"fake"},
+		{"field":"user.id","strategy":"hash"},
+		{"field":"count","strategy":"hash"},
+		{"field":"score","strategy":"redact"},
+		{"field":"active","strategy":"hash"},
+		{"field":"level","strategy":"regex","pattern":"\\d","replacement":"0"},
+		{"field":"name","strategy":"redact"},
+		{"field":"ssn","strategy":"null"},
+		{"field":"comment","strategy":"regex","pattern":"\\d{3}-\\d{4}","replacement":"xxx-xxxx"}
+	]`), 0644)
+
+	masker, err := LoadMasker(file, "salt")
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	newSource := func() map[string]interface{} {
+		source := map[string]interface{}{}
+		json.Unmarshal([]byte(`{"user":{"email":"medcl@example.com"},"phone":["+86-138-0000-1111"],"name":"medcl","ssn":"123","comment":"call 555-1234","mobile":13800001111,"score":9.5,"active":true}`), &source)
+		source["user"].(map[string]interface{})["id"] = float64(1001)
+		//numbers of scripts are int64
+		source["age"] = int64(35)
+		source["count"] = int64(7)
+		source["level"] = int64(12)
+		return source
+	}
+
+	source := newSource()
+	masker.Mask(source)
+
+	email := source["user"].(map[string]interface{})["email"].(string)
+	if len(email) != 64 || email == "medcl@example.com" {
+		test.Errorf("email not hashed, got %s", email)
+	}
+	phone := source["phone"].([]interface{})[0].(string)
+	if !regexp.MustCompile(`^\+\d{2}-\d{3}-\d{4}-\d{4}$`).MatchString(phone) || phone == "+86-138-0000-1111" {
+		test.Errorf("phone format not preserved, got %s", phone)
+	}
+	if mobile, ok := source["mobile"].(float64); !ok || mobile == 13800001111 || mobile >= 1e11 {
+		test.Errorf("number should be faked as a number, got %v", source["mobile"])
+	}
+	if age, ok := source["age"].(int64); !ok || age >= 100 {
+		test.Errorf("int64 should be faked as int64, got %#v", source["age"])
+	}
+	if id, ok := source["user"].(map[string]interface{})["id"].(float64); !ok || id == 1001 || id != float64(int64(id)) || id >= 1<<31 {
+		test.Errorf("number should be hashed as a number, got %#v", source["user"])
+	}
+	if count, ok := source["count"].(int64); !ok || count == 7 || count < 0 || count >= 1<<31 {
+		test.Errorf("int64 should be hashed as int64, got %#v", source["count"])
+	}
+	if _, ok := source["active"].(bool); !ok || source["score"] != nil || source["level"] != int64(0) {
+		test.Errorf("types of booleans and numbers should be kept, got %#v, %#v, %#v", source["active"], source["score"], source["level"])
+	}
+	if source["name"] != "***" || source["ssn"] != nil || source["comment"] != "call xxx-xxxx" {
+		test.Errorf("unexpected result, got %v", source)
+	}
+
+	//same input should always produce same output
+	another := newSource()
+	masker.Mask(another)
+	if another["user"].(map[string]interface{})["email"] != email || another["phone"].([]interface{})[0] != phone ||
+		another["count"] != source["count"] || another["age"] != source["age"] {
+		test.Errorf("masking is not deterministic")
+	}
+}
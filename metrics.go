@@ -0,0 +1,170 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds of bulk latency buckets in seconds
+var bulkLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics collect counters of a migration, exposed in the prometheus text
+// format by the control endpoint, nil metrics collect nothing
+type Metrics struct {
+	lock         sync.Mutex
+	docsRead     map[string]float64 //by input and slice
+	bytesRead    map[string]float64 //by input
+	docsWritten  map[string]float64 //by output
+	bytesWritten map[string]float64 //by output
+	bulkFailures map[string]float64 //by reason
+	bulkRetries  float64
+	bulkLatency  histogram
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 //not cumulative, the last one is +Inf
+	sum     float64
+	count   uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		docsRead:     map[string]float64{},
+		bytesRead:    map[string]float64{},
+		docsWritten:  map[string]float64{},
+		bytesWritten: map[string]float64{},
+		bulkFailures: map[string]float64{},
+		bulkLatency:  histogram{buckets: bulkLatencyBuckets, counts: make([]uint64, len(bulkLatencyBuckets)+1)},
+	}
+}
+
+// ReadDocs count documents and bytes read from the input, es or file, slice
+// is the id of sliced scroll
+func (m *Metrics) ReadDocs(input string, slice string, docs int, bytes int) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.docsRead[labels("input", input, "slice", slice)] += float64(docs)
+	m.bytesRead[labels("input", input)] += float64(bytes)
+}
+
+// WriteDocs count documents and bytes written to the output, es or file
+func (m *Metrics) WriteDocs(output string, docs int, bytes int) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.docsWritten[labels("output", output)] += float64(docs)
+	m.bytesWritten[labels("output", output)] += float64(bytes)
+}
+
+// ObserveBulk record latency of a bulk request, documents failed by reason,
+// and documents kept to be retried
+func (m *Metrics) ObserveBulk(latency time.Duration, failures map[string]int, retries int) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bulkLatency.observe(latency.Seconds())
+	for reason, n := range failures {
+		m.bulkFailures[labels("reason", reason)] += float64(n)
+	}
+	m.bulkRetries += float64(retries)
+}
+
+// FailDocs count documents failed by reason without a bulk request, eg: given
+// up after retries
+func (m *Metrics) FailDocs(reason string, docs int) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bulkFailures[labels("reason", reason)] += float64(docs)
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// WriteTo write metrics in the prometheus text format, depth and capacity of
+// the document channel are read when scraped
+func (m *Metrics) WriteTo(w io.Writer, chanDepth int, chanCap int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	writeCounter(w, "esm_docs_read_total", "Documents read from the input, by input and slice of scroll.", m.docsRead)
+	writeCounter(w, "esm_read_bytes_total", "Bytes of scroll responses and dump files read from the input.", m.bytesRead)
+	writeCounter(w, "esm_docs_written_total", "Documents written to the output.", m.docsWritten)
+	writeCounter(w, "esm_written_bytes_total", "Bytes of bulk requests and dump files written to the output.", m.bytesWritten)
+	writeCounter(w, "esm_bulk_failures_total", "Documents failed by bulk requests, by reason.", m.bulkFailures)
+	writeCounter(w, "esm_bulk_retries_total", "Documents of bulk requests kept to be retried.", map[string]float64{"": m.bulkRetries})
+
+	fmt.Fprintf(w, "# HELP esm_bulk_duration_seconds Latency of bulk requests.\n# TYPE esm_bulk_duration_seconds histogram\n")
+	cumulative := uint64(0)
+	for i, bound := range m.bulkLatency.buckets {
+		cumulative += m.bulkLatency.counts[i]
+		fmt.Fprintf(w, "esm_bulk_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "esm_bulk_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.bulkLatency.count)
+	fmt.Fprintf(w, "esm_bulk_duration_seconds_sum %g\n", m.bulkLatency.sum)
+	fmt.Fprintf(w, "esm_bulk_duration_seconds_count %d\n", m.bulkLatency.count)
+
+	fmt.Fprintf(w, "# HELP esm_doc_chan_depth Documents buffered between readers and writers.\n# TYPE esm_doc_chan_depth gauge\nesm_doc_chan_depth %d\n", chanDepth)
+	fmt.Fprintf(w, "# HELP esm_doc_chan_capacity Capacity of the document buffer.\n# TYPE esm_doc_chan_capacity gauge\nesm_doc_chan_capacity %d\n", chanCap)
+}
+
+func writeCounter(w io.Writer, name string, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if len(k) > 0 {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, k, values[k])
+		} else {
+			fmt.Fprintf(w, "%s %g\n", name, values[k])
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels returns the label pairs of a series, ie: input="es",slice="0"
+func labels(pairs ...string) string {
+	s := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		s = append(s, pairs[i]+"=\""+labelEscaper.Replace(pairs[i+1])+"\"")
+	}
+	return strings.Join(s, ",")
+}
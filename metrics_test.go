@@ -0,0 +1,75 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(test *testing.T) {
+	var metrics *Metrics
+	metrics.ReadDocs("es", "0", 10, 100)
+	metrics.ObserveBulk(time.Second, nil, 0)
+	metrics.FailDocs("retries_exhausted", 1)
+
+	migrator := &Migrator{DocChan: make(chan map[string]interface{}, 10)}
+	handler := migrator.newControlHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 404 {
+		test.Fatal("metrics should not be served if not collected", w.Code)
+	}
+
+	migrator.Metrics = NewMetrics()
+	migrator.DocChan <- map[string]interface{}{}
+	migrator.Metrics.ReadDocs("es", "0", 10, 1000)
+	migrator.Metrics.ReadDocs("es", "1", 5, 500)
+	migrator.Metrics.WriteDocs("es", 12, 800)
+	migrator.Metrics.ObserveBulk(300*time.Millisecond, map[string]int{"es_rejected_execution_exception": 3}, 3)
+	migrator.Metrics.ObserveBulk(time.Minute*2, map[string]int{`a"b`: 1}, 0)
+	migrator.Metrics.FailDocs("retries_exhausted", 4)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		`esm_docs_read_total{input="es",slice="0"} 10`,
+		`esm_docs_read_total{input="es",slice="1"} 5`,
+		`esm_read_bytes_total{input="es"} 1500`,
+		`esm_docs_written_total{output="es"} 12`,
+		`esm_written_bytes_total{output="es"} 800`,
+		`esm_bulk_failures_total{reason="es_rejected_execution_exception"} 3`,
+		`esm_bulk_failures_total{reason="a\"b"} 1`,
+		`esm_bulk_failures_total{reason="retries_exhausted"} 4`,
+		`esm_bulk_retries_total 3`,
+		`esm_bulk_duration_seconds_bucket{le="0.25"} 0`,
+		`esm_bulk_duration_seconds_bucket{le="0.5"} 1`,
+		`esm_bulk_duration_seconds_bucket{le="60"} 1`,
+		`esm_bulk_duration_seconds_bucket{le="+Inf"} 2`,
+		`esm_bulk_duration_seconds_sum 120.3`,
+		`esm_bulk_duration_seconds_count 2`,
+		`esm_doc_chan_depth 1`,
+		`esm_doc_chan_capacity 10`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			test.Fatal("missing ", line, " in\n", body)
+		}
+	}
+}
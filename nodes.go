@@ -0,0 +1,225 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// dead nodes are retried after the timeout, doubled on each failure
+const (
+	nodeDeadTimeout    = 30 * time.Second
+	nodeMaxDeadTimeout = 10 * time.Minute
+)
+
+type Node struct {
+	URL       string //eg: http://localhost:9200
+	failures  int
+	deadUntil time.Time
+}
+
+// NodePool round-robin requests of a cluster across its live nodes, failed
+// nodes are marked dead for a while, and the first node is used to build
+// request urls, which are rewritten to the selected node
+type NodePool struct {
+	lock  sync.Mutex
+	seed  string
+	nodes []*Node
+	next  int
+}
+
+// ParseHosts split the comma separated host list of a cluster
+func ParseHosts(str string) ([]string, error) {
+	hosts := []string{}
+	for _, host := range strings.Split(str, ",") {
+		host = strings.TrimRight(strings.TrimSpace(host), "/")
+		if len(host) == 0 {
+			continue
+		}
+		u, err := url.Parse(host)
+		if err != nil {
+			return nil, err
+		}
+		if len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return nil, errors.New("invalid host: " + host + ", ie: http://localhost:9200")
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("no host specified")
+	}
+	return hosts, nil
+}
+
+func NewNodePool(hosts []string) *NodePool {
+	pool := &NodePool{seed: hosts[0]}
+	for _, host := range hosts {
+		pool.nodes = append(pool.nodes, &Node{URL: host})
+	}
+	return pool
+}
+
+// Next returns the next live node, or the node to be alive first if all
+// nodes are dead
+func (p *NodePool) Next() *Node {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	for i := 0; i < len(p.nodes); i++ {
+		node := p.nodes[(p.next+i)%len(p.nodes)]
+		if node.deadUntil.Before(now) {
+			p.next = (p.next + i + 1) % len(p.nodes)
+			return node
+		}
+	}
+
+	var first *Node
+	for _, node := range p.nodes {
+		if first == nil || node.deadUntil.Before(first.deadUntil) {
+			first = node
+		}
+	}
+	return first
+}
+
+// Size returns the number of nodes
+func (p *NodePool) Size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.nodes)
+}
+
+// MarkDead mark the node dead, the only node of a cluster is always used
+func (p *NodePool) MarkDead(node *Node, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.nodes) <= 1 {
+		return
+	}
+
+	timeout := nodeDeadTimeout << uint(node.failures)
+	if timeout > nodeMaxDeadTimeout || timeout <= 0 {
+		timeout = nodeMaxDeadTimeout
+	}
+	node.failures++
+	node.deadUntil = time.Now().Add(timeout)
+	log.Warnf("node %s is marked dead for %s, %v", node.URL, timeout, err)
+}
+
+func (p *NodePool) MarkAlive(node *Node) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if node.failures > 0 {
+		log.Infof("node %s is alive", node.URL)
+	}
+	node.failures = 0
+	node.deadUntil = time.Time{}
+}
+
+// Rewrite returns the url of the node, urls not built from the first host
+// are returned as they are
+func (p *NodePool) Rewrite(r string, node *Node) string {
+	if !strings.HasPrefix(r, p.seed) {
+		return r
+	}
+	return node.URL + r[len(p.seed):]
+}
+
+// SetNodes replace nodes of the pool, status of known nodes is kept
+func (p *NodePool) SetNodes(hosts []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	known := map[string]*Node{}
+	for _, node := range p.nodes {
+		known[node.URL] = node
+	}
+	nodes := []*Node{}
+	for _, host := range hosts {
+		if node, ok := known[host]; ok {
+			nodes = append(nodes, node)
+			continue
+		}
+		nodes = append(nodes, &Node{URL: host})
+	}
+	p.nodes = nodes
+	p.next = 0
+}
+
+type nodesHTTPInfo struct {
+	Nodes map[string]struct {
+		HTTP struct {
+			PublishAddress string `json:"publish_address"`
+		} `json:"http"`
+	} `json:"nodes"`
+}
+
+// Sniff replace nodes of the cluster with the http publish addresses of
+// _nodes/http, the scheme and path of the first host are kept
+func (c *HTTPClient) Sniff() error {
+	if c.Nodes == nil {
+		return errors.New("no hosts to sniff")
+	}
+	resp, body, errs := c.Get(c.Nodes.seed + "/_nodes/http")
+	if errs != nil {
+		return errs[0]
+	}
+	if resp.StatusCode != 200 {
+		return errors.New("failed to sniff nodes: " + body)
+	}
+
+	info := nodesHTTPInfo{}
+	err := json.Unmarshal([]byte(body), &info)
+	if err != nil {
+		return err
+	}
+
+	seed, _ := url.Parse(c.Nodes.seed)
+	hosts := []string{}
+	for _, node := range info.Nodes {
+		address := node.HTTP.PublishAddress
+		if len(address) == 0 {
+			continue
+		}
+		//hostname/ip:port since elasticsearch 7
+		if i := strings.Index(address, "/"); i >= 0 {
+			address = address[i+1:]
+		}
+		u := *seed
+		u.Host = address
+		hosts = append(hosts, strings.TrimRight(u.String(), "/"))
+	}
+	if len(hosts) == 0 {
+		return errors.New("no http nodes found")
+	}
+	sort.Strings(hosts)
+
+	log.Infof("sniffed nodes: %s", strings.Join(hosts, ","))
+	c.Nodes.SetNodes(hosts)
+	return nil
+}
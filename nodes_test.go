@@ -0,0 +1,109 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNodePool(test *testing.T) {
+	lock := sync.Mutex{}
+	hits := map[string]int{}
+	handler := func(name string, status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			hits[name]++
+			lock.Unlock()
+			w.WriteHeader(status)
+			w.Write([]byte("{}"))
+		}
+	}
+	a := httptest.NewServer(handler("a", 200))
+	defer a.Close()
+	b := httptest.NewServer(handler("b", 200))
+	defer b.Close()
+	unavailable := httptest.NewServer(handler("unavailable", 503))
+	defer unavailable.Close()
+	dead := httptest.NewServer(handler("dead", 200))
+	dead.Close()
+
+	hosts, err := ParseHosts(fmt.Sprintf("%s/, %s,%s,%s", a.URL, dead.URL, unavailable.URL, b.URL))
+	if err != nil || len(hosts) != 4 || hosts[0] != a.URL {
+		test.Fatal("unexpected hosts", hosts, err)
+	}
+	if _, err = ParseHosts("localhost:9200"); err == nil {
+		test.Fatal("host without scheme should be rejected")
+	}
+
+	client, _ := NewHTTPClient(hosts, nil, "", nil, nil)
+	for i := 0; i < 10; i++ {
+		resp, _, errs := client.Get(hosts[0] + "/_search")
+		if errs != nil || resp.StatusCode != 200 {
+			test.Fatal("request should fail over to live nodes", errs)
+		}
+	}
+	if hits["a"] != 5 || hits["b"] != 5 || hits["unavailable"] != 1 {
+		test.Fatal("requests should be distributed across live nodes", hits)
+	}
+
+	//bulk may be applied partly by an unavailable node, it is not sent again
+	client, _ = NewHTTPClient([]string{unavailable.URL, a.URL}, nil, "", nil, nil)
+	if resp, _, _ := client.Post(unavailable.URL+"/_bulk", "{}"); resp == nil || resp.StatusCode != 503 || hits["a"] != 5 {
+		test.Fatal("bulk should not fail over after it is sent", hits)
+	}
+	client, _ = NewHTTPClient([]string{dead.URL, a.URL}, nil, "", nil, nil)
+	if resp, _, errs := client.Post(dead.URL+"/_bulk", "{}"); errs != nil || resp.StatusCode != 200 || hits["a"] != 6 {
+		test.Fatal("bulk should fail over if the node can't be connected", errs, hits)
+	}
+
+	//the only node is always used
+	client, _ = NewHTTPClient([]string{unavailable.URL}, nil, "", nil, nil)
+	for i := 0; i < 2; i++ {
+		if resp, _, _ := client.Get(unavailable.URL); resp == nil || resp.StatusCode != 503 {
+			test.Fatal("the only node should not be marked dead")
+		}
+	}
+}
+
+func TestSniff(test *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer node.Close()
+	address := strings.TrimPrefix(node.URL, "http://")
+
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"nodes":{"n1":{"http":{"publish_address":"localhost/` + address + `"}},"n2":{"http":{"publish_address":"` + address + `"}}}}`))
+	}))
+	defer seed.Close()
+
+	client, _ := NewHTTPClient([]string{seed.URL}, nil, "", nil, nil)
+	if err := client.Sniff(); err != nil {
+		test.Fatal(err)
+	}
+	if client.Nodes.Size() != 2 || client.Nodes.Next().URL != node.URL {
+		test.Fatal("unexpected sniffed nodes", client.Nodes.nodes)
+	}
+	if client.Nodes.Rewrite(seed.URL+"/_bulk", client.Nodes.Next()) != node.URL+"/_bulk" {
+		test.Fatal("urls should be rewritten to sniffed nodes")
+	}
+}
@@ -0,0 +1,450 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// kinds of parquet columns, mapped from field types of index mapping
+const (
+	parquetString    = "string"
+	parquetJSON      = "json"
+	parquetInt64     = "int64"
+	parquetInt32     = "int32"
+	parquetInt16     = "int16"
+	parquetInt8      = "int8"
+	parquetFloat     = "float"
+	parquetDouble    = "double"
+	parquetBoolean   = "boolean"
+	parquetTimestamp = "timestamp"
+	parquetStruct    = "struct"
+	parquetList      = "list"
+)
+
+var parquetKinds = map[string]string{
+	"keyword": parquetString, "text": parquetString, "string": parquetString,
+	"long": parquetInt64, "integer": parquetInt32, "short": parquetInt16, "byte": parquetInt8,
+	"float": parquetFloat, "half_float": parquetFloat, "double": parquetDouble, "scaled_float": parquetDouble,
+	"boolean": parquetBoolean, "date": parquetTimestamp, "date_nanos": parquetTimestamp,
+	"object": parquetStruct, "nested": parquetList,
+}
+
+var parquetTags = map[string]string{
+	parquetString:    "type=BYTE_ARRAY, convertedtype=UTF8",
+	parquetJSON:      "type=BYTE_ARRAY, convertedtype=UTF8",
+	parquetInt64:     "type=INT64",
+	parquetInt32:     "type=INT32",
+	parquetInt16:     "type=INT32, convertedtype=INT_16",
+	parquetInt8:      "type=INT32, convertedtype=INT_8",
+	parquetFloat:     "type=FLOAT",
+	parquetDouble:    "type=DOUBLE",
+	parquetBoolean:   "type=BOOLEAN",
+	parquetTimestamp: "type=INT64, convertedtype=TIMESTAMP_MILLIS",
+}
+
+// formats of date strings, besides epoch millis
+var parquetDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z0700", //offsets without colon, eg: +0800
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+}
+
+// ParquetSchema is the schema of parquet files derived from index mappings,
+// objects are structs, nested fields are lists of structs, other field types
+// like geo_point are written as json strings
+type ParquetSchema struct {
+	Fields []*parquetField
+}
+
+type parquetField struct {
+	Name   string
+	Kind   string
+	Fields []*parquetField
+}
+
+// NewParquetSchema returns schema of the source indexes, mappings of multiple
+// indexes are merged, a field of conflicting types is written as json string
+func (c *Migrator) NewParquetSchema() (*ParquetSchema, error) {
+	_, _, indexes, err := c.SourceESAPI.GetIndexMappings(c.Config.CopyAllIndexes, c.Config.SourceIndexNames)
+	if err != nil {
+		return nil, err
+	}
+	mappings := []map[string]interface{}{}
+	for _, v := range *indexes {
+		if index, ok := v.(map[string]interface{}); ok {
+			if m, ok := index["mappings"].(map[string]interface{}); ok {
+				mappings = append(mappings, m)
+			}
+		}
+	}
+	if len(mappings) == 0 {
+		return nil, errors.New("index mappings not found, " + c.Config.SourceIndexNames)
+	}
+
+	fields := []*parquetField{}
+	for _, m := range mappings {
+		//mappings of elasticsearch 7+ have no types
+		if properties, ok := m["properties"].(map[string]interface{}); ok {
+			fields = mergeParquetFields(fields, parseParquetFields(properties))
+			continue
+		}
+		for _, t := range m {
+			if typeMapping, ok := t.(map[string]interface{}); ok {
+				properties, _ := typeMapping["properties"].(map[string]interface{})
+				fields = mergeParquetFields(fields, parseParquetFields(properties))
+			}
+		}
+	}
+	return &ParquetSchema{Fields: fields}, nil
+}
+
+func parseParquetFields(properties map[string]interface{}) []*parquetField {
+	fields := []*parquetField{}
+	for name, v := range properties {
+		//names are part of schema tags
+		if strings.ContainsAny(name, ",=") {
+			log.Warnf("field %s can't be a parquet column, skipped", name)
+			continue
+		}
+		mapping, _ := v.(map[string]interface{})
+		typ, _ := mapping["type"].(string)
+		properties, hasProperties := mapping["properties"].(map[string]interface{})
+		if len(typ) == 0 && hasProperties {
+			typ = "object"
+		}
+
+		field := &parquetField{Name: name, Kind: parquetKinds[typ]}
+		switch field.Kind {
+		case "":
+			field.Kind = parquetJSON
+		case parquetStruct, parquetList:
+			field.Fields = parseParquetFields(properties)
+			if len(field.Fields) == 0 {
+				field.Kind = parquetJSON
+			}
+		}
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+func mergeParquetFields(fields, others []*parquetField) []*parquetField {
+	byName := map[string]*parquetField{}
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+	for _, other := range others {
+		field, ok := byName[other.Name]
+		switch {
+		case !ok:
+			fields = append(fields, other)
+			byName[other.Name] = other
+		case field.Kind != other.Kind:
+			field.Kind, field.Fields = parquetJSON, nil
+		case len(field.Fields) > 0:
+			field.Fields = mergeParquetFields(field.Fields, other.Fields)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+// Columns returns sorted csv columns of the schema, fields of objects are
+// flattened into dotted columns, other fields are one column each
+func (s *ParquetSchema) Columns() []string {
+	columns := schemaColumns(s.Fields, "")
+	sort.Strings(columns)
+	return columns
+}
+
+func schemaColumns(fields []*parquetField, prefix string) []string {
+	columns := []string{}
+	for _, field := range fields {
+		if field.Kind == parquetStruct {
+			columns = append(columns, schemaColumns(field.Fields, prefix+field.Name+".")...)
+			continue
+		}
+		columns = append(columns, prefix+field.Name)
+	}
+	return columns
+}
+
+type parquetSchemaItem struct {
+	Tag    string               `json:"Tag"`
+	Fields []*parquetSchemaItem `json:"Fields,omitempty"`
+}
+
+// JSON returns the schema in json format of parquet-go, document metadata
+// _index and _id are the first columns
+func (s *ParquetSchema) JSON() string {
+	root := &parquetSchemaItem{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+	for _, name := range []string{"_index", "_id"} {
+		root.Fields = append(root.Fields, &parquetSchemaItem{Tag: "name=" + name + ", " + parquetTags[parquetString] + ", repetitiontype=REQUIRED"})
+	}
+	for _, field := range s.Fields {
+		root.Fields = append(root.Fields, field.schemaItem())
+	}
+	data, _ := json.Marshal(root)
+	return string(data)
+}
+
+func (f *parquetField) schemaItem() *parquetSchemaItem {
+	children := []*parquetSchemaItem{}
+	for _, field := range f.Fields {
+		children = append(children, field.schemaItem())
+	}
+
+	switch f.Kind {
+	case parquetStruct:
+		return &parquetSchemaItem{Tag: "name=" + f.Name + ", repetitiontype=OPTIONAL", Fields: children}
+	case parquetList:
+		element := &parquetSchemaItem{Tag: "name=element, repetitiontype=REQUIRED", Fields: children}
+		return &parquetSchemaItem{Tag: "name=" + f.Name + ", type=LIST, repetitiontype=OPTIONAL", Fields: []*parquetSchemaItem{element}}
+	}
+	return &parquetSchemaItem{Tag: "name=" + f.Name + ", " + parquetTags[f.Kind] + ", repetitiontype=OPTIONAL"}
+}
+
+// Row convert the document into a row of the schema, values can't be
+// converted to the column type are written as null, arrays of a single value
+// column are written as the first value
+func (s *ParquetSchema) Row(doc map[string]interface{}, warn func(path, msg string)) map[string]interface{} {
+	row := map[string]interface{}{}
+	row["_index"], _ = doc["_index"].(string)
+	row["_id"], _ = doc["_id"].(string)
+	source, _ := doc["_source"].(map[string]interface{})
+	for _, field := range s.Fields {
+		if v := field.value(source[field.Name], field.Name, warn); v != nil {
+			row[field.Name] = v
+		}
+	}
+	return row
+}
+
+func (f *parquetField) value(v interface{}, path string, warn func(path, msg string)) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	switch f.Kind {
+	case parquetStruct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			warn(path, "not an object")
+			return nil
+		}
+		return f.structValue(obj, path, warn)
+	case parquetList:
+		items, ok := v.([]interface{})
+		if !ok {
+			items = []interface{}{v}
+		}
+		list := []interface{}{}
+		for _, item := range items {
+			if obj, ok := item.(map[string]interface{}); ok {
+				list = append(list, f.structValue(obj, path, warn))
+			}
+		}
+		return list
+	case parquetJSON:
+		if str, ok := v.(string); ok {
+			return str
+		}
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+
+	if items, ok := v.([]interface{}); ok {
+		if len(items) == 0 {
+			return nil
+		}
+		if len(items) > 1 {
+			warn(path, "array values are truncated to the first one")
+		}
+		v = items[0]
+	}
+
+	value, ok := parquetScalar(f.Kind, v)
+	if !ok {
+		warn(path, "value can't be converted to "+f.Kind)
+		return nil
+	}
+	return value
+}
+
+func (f *parquetField) structValue(obj map[string]interface{}, path string, warn func(path, msg string)) map[string]interface{} {
+	value := map[string]interface{}{}
+	for _, field := range f.Fields {
+		if v := field.value(obj[field.Name], path+"."+field.Name, warn); v != nil {
+			value[field.Name] = v
+		}
+	}
+	return value
+}
+
+func parquetScalar(kind string, v interface{}) (interface{}, bool) {
+	switch kind {
+	case parquetString:
+		switch v := v.(type) {
+		case string:
+			return v, true
+		case map[string]interface{}:
+			return nil, false
+		}
+		data, _ := json.Marshal(v)
+		return string(data), true
+	case parquetBoolean:
+		switch v := v.(type) {
+		case bool:
+			return v, true
+		case string:
+			b, err := strconv.ParseBool(v)
+			return b, err == nil
+		}
+		return nil, false
+	case parquetFloat, parquetDouble:
+		switch v := v.(type) {
+		case float64:
+			return v, true
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			return f, err == nil
+		}
+		return nil, false
+	case parquetTimestamp:
+		return parquetTimestampValue(v)
+	}
+
+	//integers
+	var i int64
+	switch v := v.(type) {
+	case float64:
+		if v != math.Trunc(v) || v > math.MaxInt64 || v < math.MinInt64 {
+			return nil, false
+		}
+		i = int64(v)
+	case string:
+		var err error
+		if i, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	bits := map[string]uint{parquetInt32: 32, parquetInt16: 16, parquetInt8: 8}[kind]
+	if bits > 0 && (i >= 1<<(bits-1) || i < -1<<(bits-1)) {
+		return nil, false
+	}
+	return i, true
+}
+
+// parquetTimestampValue returns epoch millis of date values
+func parquetTimestampValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case float64:
+		return int64(v), true
+	case string:
+		if millis, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return millis, true
+		}
+		for _, layout := range parquetDateLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UnixNano() / int64(time.Millisecond), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// parquetEncoder encode documents into rows, rows are written by the part
+// writer returned by Wrap, as parquet files can't be concatenated
+type parquetEncoder struct {
+	schema *ParquetSchema
+	codec  parquet.CompressionCodec
+	warned map[string]bool
+}
+
+func newParquetEncoder(schema *ParquetSchema, compress string) (*parquetEncoder, error) {
+	if schema == nil {
+		return nil, errors.New("parquet schema not found")
+	}
+	e := &parquetEncoder{schema: schema, warned: map[string]bool{}}
+	switch strings.ToLower(compress) {
+	case "":
+		e.codec = parquet.CompressionCodec_SNAPPY
+	case "gzip", "gz":
+		e.codec = parquet.CompressionCodec_GZIP
+	case "zstd", "zst":
+		e.codec = parquet.CompressionCodec_ZSTD
+	case "none":
+		e.codec = parquet.CompressionCodec_UNCOMPRESSED
+	default:
+		return nil, errors.New("unsupported compression: " + compress + ", options: gzip,zstd,none")
+	}
+	return e, nil
+}
+
+func (e *parquetEncoder) Encode(doc map[string]interface{}) ([]byte, error) {
+	return json.Marshal(e.schema.Row(doc, e.warn))
+}
+
+// warn once for each field
+func (e *parquetEncoder) warn(path, msg string) {
+	if !e.warned[path] {
+		e.warned[path] = true
+		log.Warnf("parquet column %s, %s", path, msg)
+	}
+}
+
+// Wrap returns the writer of a parquet file, a row is written each time
+func (e *parquetEncoder) Wrap(w io.Writer) (io.WriteCloser, error) {
+	pw, err := writer.NewJSONWriterFromWriter(e.schema.JSON(), w, 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.CompressionType = e.codec
+	return &parquetPartWriter{pw: pw}, nil
+}
+
+type parquetPartWriter struct {
+	pw *writer.JSONWriter
+}
+
+func (p *parquetPartWriter) Write(row []byte) (int, error) {
+	return len(row), p.pw.Write(string(row))
+}
+
+func (p *parquetPartWriter) Close() error {
+	return p.pw.WriteStop()
+}
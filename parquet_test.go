@@ -0,0 +1,155 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestParquetSchema(test *testing.T) {
+	mapping := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"name": {"type": "keyword"},
+		"age": {"type": "integer"},
+		"created": {"type": "date"},
+		"location": {"type": "geo_point"},
+		"user": {"properties": {"city": {"type": "text"}, "vip": {"type": "boolean"}}},
+		"comments": {"type": "nested", "properties": {"text": {"type": "text"}, "likes": {"type": "long"}}}
+	}`), &mapping)
+	fields := parseParquetFields(mapping)
+
+	//same field of another index in different type
+	fields = mergeParquetFields(fields, []*parquetField{{Name: "age", Kind: parquetString}, {Name: "score", Kind: parquetDouble}})
+
+	kinds := map[string]string{}
+	for _, field := range fields {
+		kinds[field.Name] = field.Kind
+	}
+	expected := map[string]string{"name": parquetString, "age": parquetJSON, "created": parquetTimestamp, "location": parquetJSON,
+		"user": parquetStruct, "comments": parquetList, "score": parquetDouble}
+	if !reflect.DeepEqual(kinds, expected) {
+		test.Errorf("unexpected kinds %v", kinds)
+	}
+
+	schema := &ParquetSchema{Fields: fields}
+	if columns := fmt.Sprint(schema.Columns()); columns != "[age comments created location name score user.city user.vip]" {
+		test.Errorf("unexpected csv columns %s", columns)
+	}
+	item := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(schema.JSON()), &item); err != nil {
+		test.Fatal(err)
+	}
+	if len(item["Fields"].([]interface{})) != len(fields)+2 {
+		test.Errorf("unexpected schema %s", schema.JSON())
+	}
+
+	doc := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"_index": "a", "_id": "1", "_source": {
+		"name": ["x", "y"],
+		"age": 30,
+		"created": "2020-01-02T03:04:05Z",
+		"location": {"lat": 1, "lon": 2},
+		"user": {"city": "berlin", "vip": "yes"},
+		"comments": {"text": "hi", "likes": 1.5},
+		"score": "1.5"
+	}}`), &doc)
+
+	warnings := map[string]bool{}
+	row := schema.Row(doc, func(path, msg string) { warnings[path] = true })
+	expectedRow := map[string]interface{}{
+		"_index":   "a",
+		"_id":      "1",
+		"name":     "x",
+		"age":      "30",
+		"created":  int64(1577934245000),
+		"location": `{"lat":1,"lon":2}`,
+		"user":     map[string]interface{}{"city": "berlin"},
+		"comments": []interface{}{map[string]interface{}{"text": "hi"}},
+		"score":    1.5,
+	}
+	if !reflect.DeepEqual(row, expectedRow) {
+		test.Errorf("unexpected row %v", row)
+	}
+	if !reflect.DeepEqual(warnings, map[string]bool{"name": true, "user.vip": true, "comments.likes": true}) {
+		test.Errorf("unexpected warnings %v", warnings)
+	}
+}
+
+func TestParquetWriter(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+
+	schema := &ParquetSchema{Fields: []*parquetField{
+		{Name: "name", Kind: parquetString},
+		{Name: "age", Kind: parquetInt64},
+		{Name: "created", Kind: parquetTimestamp},
+	}}
+	encoder, err := newParquetEncoder(schema, "")
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	//the second run overwrites the file of the first one
+	file := filepath.Join(dir, "dump.parquet")
+	ioutil.WriteFile(file, []byte("old content"), 0644)
+	for run := 0; run < 2; run++ {
+		w := &DumpWriter{File: file, Compress: "none", Truncate: true, Wrap: encoder.Wrap}
+		for _, created := range []string{"2020-01-02T11:04:05+0800", "2020-01-02T03:04:05.5Z"} {
+			row, err := encoder.Encode(map[string]interface{}{"_index": "a", "_id": created[:4],
+				"_source": map[string]interface{}{"name": "x", "age": float64(30 + run), "created": created}})
+			if err != nil {
+				test.Fatal(err)
+			}
+			if err = w.Write("a", row); err != nil {
+				test.Fatal(err)
+			}
+		}
+		if err = w.Close(); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	f, err := local.NewLocalFileReader(file)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer f.Close()
+	pr, err := reader.NewParquetReader(f, nil, 1)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer pr.ReadStop()
+	rows, err := pr.ReadByNumber(int(pr.GetNumRows()))
+	if err != nil || len(rows) != 2 {
+		test.Fatal("unexpected rows", rows, err)
+	}
+	data, _ := json.Marshal(rows)
+	expected := `[{"PARGO_PREFIX__index":"a","PARGO_PREFIX__id":"2020","Name":"x","Age":31,"Created":1577934245000},` +
+		`{"PARGO_PREFIX__index":"a","PARGO_PREFIX__id":"2020","Name":"x","Age":31,"Created":1577934245500}]`
+	if string(data) != expected {
+		test.Errorf("unexpected rows %s", data)
+	}
+}
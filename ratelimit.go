@@ -0,0 +1,107 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limit documents and bytes per second with token buckets, shared
+// by workers, limits can be changed at runtime, 0 for no limit
+type RateLimiter struct {
+	lock  sync.Mutex
+	docs  tokenBucket
+	bytes tokenBucket
+}
+
+// tokenBucket allow a burst of one second, taking more tokens than available
+// put the bucket in debt, which is paid by waiting
+type tokenBucket struct {
+	rate   float64 //tokens per second
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(docsPerSec int, bytesPerSec int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetLimits(docsPerSec, bytesPerSec)
+	return l
+}
+
+// Wait block until docs and bytes are allowed, nil limiter doesn't wait
+func (l *RateLimiter) Wait(docs int, bytes int) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	wait := l.docs.take(float64(docs), now)
+	if w := l.bytes.take(float64(bytes), now); w > wait {
+		wait = w
+	}
+	l.lock.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (l *RateLimiter) SetLimits(docsPerSec int, bytesPerSec int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.docs.setRate(float64(docsPerSec))
+	l.bytes.setRate(float64(bytesPerSec))
+}
+
+func (l *RateLimiter) Limits() (int, int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int(l.docs.rate), int64(l.bytes.rate)
+}
+
+// take n tokens, returns the time to wait if the bucket is in debt
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 || n <= 0 {
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+	}
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	if rate < 0 {
+		rate = 0
+	}
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
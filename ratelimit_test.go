@@ -0,0 +1,75 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(test *testing.T) {
+	now := time.Now()
+	bucket := tokenBucket{rate: 100}
+	if wait := bucket.take(100, now); wait != 0 {
+		test.Fatal("burst of one second should be allowed", wait)
+	}
+	if wait := bucket.take(50, now); wait != 500*time.Millisecond {
+		test.Fatal("debt should be paid by waiting", wait)
+	}
+	if wait := bucket.take(50, now.Add(time.Second)); wait != 0 {
+		test.Fatal("tokens should be refilled", wait)
+	}
+	bucket.setRate(0)
+	if wait := bucket.take(1000000, now.Add(time.Second)); wait != 0 {
+		test.Fatal("0 should be no limit", wait)
+	}
+
+	var limiter *RateLimiter
+	limiter.Wait(100, 100)
+
+	limiter = NewRateLimiter(0, 1000)
+	start := time.Now()
+	limiter.Wait(1000, 1000)
+	limiter.Wait(1000, 200)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		test.Fatal("bytes should be limited", elapsed)
+	}
+}
+
+func TestControlRate(test *testing.T) {
+	migrator := &Migrator{ReadLimiter: NewRateLimiter(100, 0), WriteLimiter: NewRateLimiter(100, 0)}
+	handler := migrator.newControlHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/rate?bytes_per_sec=2048", nil))
+	limits := map[string]rateLimits{}
+	json.Unmarshal(w.Body.Bytes(), &limits)
+	if w.Code != 200 || limits["read"].DocsPerSec != 100 || limits["write"].BytesPerSec != 2048 {
+		test.Fatal("unexpected limits", w.Code, w.Body.String())
+	}
+	if docs, bytes := migrator.ReadLimiter.Limits(); docs != 100 || bytes != 2048 {
+		test.Fatal("limits should be changed", docs, bytes)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/rate?docs_per_sec=-1", nil))
+	if w.Code != 400 {
+		test.Fatal("invalid limits should be rejected", w.Code)
+	}
+}
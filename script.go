@@ -0,0 +1,102 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/dop251/goja"
+	log "github.com/cihub/seelog"
+)
+
+// the script should define a function named process, eg:
+//   function process(doc) {
+//       if (doc._source.deleted) { return null; }
+//       doc._source.message = doc._source.msg;
+//       delete doc._source.msg;
+//       return doc;
+//   }
+// doc contains _index, _type, _id and _source, the function returns
+// null to drop the document, an object, or an array of objects
+const scriptFunctionName = "process"
+
+func CompileScript(file string) (*goja.Program, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return goja.Compile(file, string(data), false)
+}
+
+// ScriptRuntime wraps a javascript vm, the vm is not thread safe, so every
+// worker should have its own runtime
+type ScriptRuntime struct {
+	vm      *goja.Runtime
+	process goja.Callable
+}
+
+func NewScriptRuntime(program *goja.Program) (*ScriptRuntime, error) {
+	vm := goja.New()
+	vm.Set("log", func(msg ...interface{}) {
+		log.Info(msg...)
+	})
+
+	_, err := vm.RunProgram(program)
+	if err != nil {
+		return nil, err
+	}
+
+	process, ok := goja.AssertFunction(vm.Get(scriptFunctionName))
+	if !ok {
+		return nil, errors.New("function " + scriptFunctionName + "(doc) is not defined in script")
+	}
+
+	return &ScriptRuntime{vm: vm, process: process}, nil
+}
+
+func (s *ScriptRuntime) Process(doc map[string]interface{}) ([]map[string]interface{}, error) {
+	result, err := s.process(goja.Undefined(), s.vm.ToValue(doc))
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil || goja.IsUndefined(result) || goja.IsNull(result) {
+		return nil, nil
+	}
+
+	switch v := result.Export().(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}, nil
+	case []interface{}:
+		docs := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			if item == nil {
+				continue
+			}
+			d, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("script returned invalid document: %v", item)
+			}
+			docs = append(docs, d)
+		}
+		return docs, nil
+	}
+
+	return nil, fmt.Errorf("script returned invalid result: %v", result)
+}
@@ -20,15 +20,90 @@ import (
 	"gopkg.in/cheggaaa/pb.v1"
 	"encoding/json"
 	log "github.com/cihub/seelog"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
 )
 
+// BuildScrollQuery returns the query clause of scroll request, the query dsl
+// from file or inline is used verbatim, otherwise the query string is wrapped
+// into a query_string query, nil means match all
+func BuildScrollQuery(c *Config) (map[string]interface{}, error) {
+	dsl := c.QueryDSL
+	if len(c.QueryFile) > 0 {
+		if len(dsl) > 0 {
+			return nil, errors.New("query_file and query_dsl can't be used together")
+		}
+		data, err := ioutil.ReadFile(c.QueryFile)
+		if err != nil {
+			return nil, err
+		}
+		dsl = string(data)
+	}
+
+	if len(dsl) > 0 {
+		if len(c.Query) > 0 {
+			return nil, errors.New("query can't be used together with query_file or query_dsl")
+		}
+		query := map[string]interface{}{}
+		err := json.Unmarshal([]byte(dsl), &query)
+		if err != nil {
+			return nil, errors.New("invalid query dsl, " + err.Error())
+		}
+		// also accept a full search body like {"query":{...}}
+		if inner, ok := query["query"].(map[string]interface{}); ok && len(query) == 1 {
+			query = inner
+		}
+		return query, nil
+	}
+
+	if len(c.Query) > 0 {
+		return map[string]interface{}{
+			"query_string": map[string]interface{}{
+				"query": c.Query,
+			},
+		}, nil
+	}
+
+	return nil, nil
+}
+
+
+// BuildScrollSort parse sort option like "field1:asc,field2:desc,field3" to
+// the sort clause of scroll request, order is asc if not specified
+func BuildScrollSort(sort string) ([]interface{}, error) {
+	if len(strings.TrimSpace(sort)) == 0 {
+		return nil, nil
+	}
+
+	sorts := []interface{}{}
+	for _, item := range strings.Split(sort, ",") {
+		item = strings.TrimSpace(item)
+		field, order := item, "asc"
+		if i := strings.LastIndex(item, ":"); i > 0 {
+			field, order = item[:i], strings.ToLower(item[i+1:])
+		}
+		if len(field) == 0 || (order != "asc" && order != "desc") {
+			return nil, errors.New("invalid sort: " + item + ", should be like field:asc or field:desc")
+		}
+		sorts = append(sorts, map[string]interface{}{
+			field: map[string]interface{}{"order": order},
+		})
+	}
+	return sorts, nil
+}
 
 // Stream from source es instance. "done" is an indicator that the stream is
 // over
 func (s *Scroll) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar){
 
+	//slow down scrolling if reads are limited
+	c.ReadLimiter.Wait(len(s.Hits.Docs), s.Bytes)
+
 	//update progress bar
 	bar.Add(len(s.Hits.Docs))
+	c.Metrics.ReadDocs("es", strconv.Itoa(s.Slice), len(s.Hits.Docs), s.Bytes)
 
 	// show any failures
 	for _, failure := range s.Shards.Failures {
@@ -55,6 +130,7 @@ func (s *Scroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
 		return true
 	}
 
+	scroll.Slice=s.Slice
 	scroll.ProcessScrollResult(c,bar)
 
 	//update scrollId
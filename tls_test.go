@@ -0,0 +1,77 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTLSConfig(test *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+	config, err := NewTLSConfig("", "", "", false)
+	if config != nil || err != nil {
+		test.Fatal("unexpected tls config without options", config, err)
+	}
+	client, _ := NewHTTPClient(nil, nil, "", nil, nil)
+	if _, _, errs := client.Get(server.URL); errs == nil {
+		test.Fatal("unknown certificate should be rejected")
+	}
+
+	for _, insecure := range []bool{false, true} {
+		file := ca
+		if insecure {
+			file = ""
+		}
+		config, err = NewTLSConfig(file, "", "", insecure)
+		if err != nil {
+			test.Fatal(err)
+		}
+		client, _ = NewHTTPClient(nil, nil, "", config, nil)
+		if _, _, errs := client.Get(server.URL); errs != nil {
+			test.Fatal(errs)
+		}
+		if _, _, errs := client.Post(server.URL, "{}"); errs != nil {
+			test.Fatal(errs)
+		}
+		if _, err := client.Request("PUT", server.URL, bytes.NewBufferString("{}")); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	if _, err = NewTLSConfig("", ca, "", false); err == nil {
+		test.Fatal("client certificate without key should be rejected")
+	}
+	if _, err = NewTLSConfig(filepath.Join(dir, "missing.pem"), "", "", false); err == nil {
+		test.Fatal("missing ca file should be rejected")
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// TransformRule is one entry of the transform rule file, eg:
+// [{"action":"rename","field":"msg","target":"message"},
+//  {"action":"remove","field":"user.ssn"},
+//  {"action":"set","field":"env","value":"staging"},
+//  {"action":"copy","field":"title","target":"title_raw"},
+//  {"action":"move","field":"city","target":"address.city"}]
+// all field paths are dotted paths relative to _source
+type TransformRule struct {
+	Action string      `json:"action"`
+	Field  string      `json:"field"`
+	Target string      `json:"target"`
+	Value  interface{} `json:"value"`
+}
+
+func LoadTransformRules(file string) ([]TransformRule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []TransformRule{}
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		if len(rule.Field) == 0 {
+			return nil, fmt.Errorf("transform rule %d: field is required", i)
+		}
+		switch rule.Action {
+		case "rename":
+			if len(rule.Target) == 0 || strings.Contains(rule.Target, ".") {
+				return nil, fmt.Errorf("transform rule %d: rename target should be a plain field name, use move for nested path", i)
+			}
+		case "copy", "move":
+			if len(rule.Target) == 0 {
+				return nil, fmt.Errorf("transform rule %d: target is required for %s", i, rule.Action)
+			}
+		case "remove", "set":
+		default:
+			return nil, errors.New("unknown transform action: " + rule.Action)
+		}
+	}
+
+	log.Debugf("loaded %d transform rules from %s", len(rules), file)
+	return rules, nil
+}
+
+// DocTransformer apply transform rules, the script and then masking to
+// documents read from DocChan, it is not thread safe, every worker should
+// create its own one
+type DocTransformer struct {
+	rules  []TransformRule
+	script *ScriptRuntime
+	masker *Masker
+}
+
+func (c *Migrator) NewDocTransformer() (*DocTransformer, error) {
+	t := &DocTransformer{rules: c.TransformRules, masker: c.Masker}
+	if c.Script != nil {
+		script, err := NewScriptRuntime(c.Script)
+		if err != nil {
+			return nil, err
+		}
+		t.script = script
+	}
+	return t, nil
+}
+
+// Transform returns zero, one or many documents for the input document
+func (t *DocTransformer) Transform(doc map[string]interface{}) ([]map[string]interface{}, error) {
+	if len(t.rules) > 0 {
+		if source, ok := doc["_source"].(map[string]interface{}); ok {
+			ApplyTransformRules(t.rules, source)
+		}
+	}
+
+	docs := []map[string]interface{}{doc}
+	if t.script != nil {
+		var err error
+		docs, err = t.script.Process(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//mask at last, so that nothing can bring sensitive data back
+	if t.masker != nil {
+		for _, d := range docs {
+			if source, ok := d["_source"].(map[string]interface{}); ok {
+				t.masker.Mask(source)
+			}
+		}
+	}
+
+	return docs, nil
+}
+
+// ApplyTransformRules apply rules to document source in order
+func ApplyTransformRules(rules []TransformRule, source map[string]interface{}) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case "rename":
+			if v, ok := getFieldByPath(source, rule.Field); ok {
+				deleteFieldByPath(source, rule.Field)
+				target := rule.Target
+				if i := strings.LastIndex(rule.Field, "."); i > 0 {
+					target = rule.Field[:i+1] + rule.Target
+				}
+				setFieldByPath(source, target, v)
+			}
+		case "move":
+			if v, ok := getFieldByPath(source, rule.Field); ok {
+				deleteFieldByPath(source, rule.Field)
+				setFieldByPath(source, rule.Target, v)
+			}
+		case "copy":
+			if v, ok := getFieldByPath(source, rule.Field); ok {
+				setFieldByPath(source, rule.Target, copyValue(v))
+			}
+		case "remove":
+			deleteFieldByPath(source, rule.Field)
+		case "set":
+			setFieldByPath(source, rule.Field, copyValue(rule.Value))
+		}
+	}
+}
+
+func getFieldByPath(source map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	current := source
+	for i, key := range keys {
+		v, ok := current[key]
+		if !ok {
+			return nil, false
+		}
+		if i == len(keys)-1 {
+			return v, true
+		}
+		current, ok = v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// setFieldByPath set value to path, missing or non-object parents will be replaced by objects
+func setFieldByPath(source map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	current := source
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := current[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			current[key] = next
+		}
+		current = next
+	}
+	current[keys[len(keys)-1]] = value
+}
+
+func deleteFieldByPath(source map[string]interface{}, path string) {
+	keys := strings.Split(path, ".")
+	current := source
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := current[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		current = next
+	}
+	delete(current, keys[len(keys)-1])
+}
+
+// copyValue deep copy objects and arrays, so copied fields don't share state
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			m[k] = copyValue(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, item := range t {
+			a[i] = copyValue(item)
+		}
+		return a
+	}
+	return v
+}
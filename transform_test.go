@@ -0,0 +1,99 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestApplyTransformRules(test *testing.T) {
+	rules := []TransformRule{}
+	err := json.Unmarshal([]byte(`[
+		{"action":"rename","field":"user.msg","target":"message"},
+		{"action":"remove","field":"user.ssn"},
+		{"action":"set","field":"env","value":"staging"},
+		{"action":"copy","field":"title","target":"meta.title_raw"},
+		{"action":"move","field":"city","target":"address.city"}
+	]`), &rules)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	source := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"user":{"msg":"hi","ssn":"123"},"title":"esm","city":"beijing"}`), &source)
+
+	ApplyTransformRules(rules, source)
+
+	b, _ := json.Marshal(source)
+	expected := `{"address":{"city":"beijing"},"env":"staging","meta":{"title_raw":"esm"},"title":"esm","user":{"message":"hi"}}`
+	if string(b) != expected {
+		test.Errorf("unexpected result, got %s", string(b))
+	}
+}
+
+func TestScriptTransform(test *testing.T) {
+	program, err := goja.Compile("test.js", `
+		function process(doc) {
+			if (doc._source.deleted) {
+				return null;
+			}
+			if (doc._source.tags) {
+				var docs = [];
+				for (var i = 0; i < doc._source.tags.length; i++) {
+					docs.push({_index: doc._index, _type: doc._type, _id: doc._id + "-" + i, _source: {tag: doc._source.tags[i]}});
+				}
+				return docs;
+			}
+			doc._source.fixed = true;
+			return doc;
+		}`, false)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	migrator := Migrator{Script: program}
+	transformer, err := migrator.NewDocTransformer()
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	newDoc := func(source string) map[string]interface{} {
+		doc := map[string]interface{}{"_index": "idx", "_type": "doc", "_id": "1"}
+		s := map[string]interface{}{}
+		json.Unmarshal([]byte(source), &s)
+		doc["_source"] = s
+		return doc
+	}
+
+	docs, err := transformer.Transform(newDoc(`{"deleted":true}`))
+	if err != nil || len(docs) != 0 {
+		test.Errorf("expected document dropped, got %v %v", docs, err)
+	}
+
+	docs, err = transformer.Transform(newDoc(`{"tags":["a","b"]}`))
+	if err != nil || len(docs) != 2 || docs[1]["_id"] != "1-1" {
+		test.Errorf("expected document split, got %v %v", docs, err)
+	}
+
+	docs, err = transformer.Transform(newDoc(`{"name":"esm"}`))
+	if err != nil || len(docs) != 1 || docs[0]["_source"].(map[string]interface{})["fixed"] != true {
+		test.Errorf("expected document fixed, got %v %v", docs, err)
+	}
+}
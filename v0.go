@@ -30,14 +30,13 @@ import (
 
 type ESAPIV0 struct {
         Host      string //eg: http://localhost:9200
-        Auth      *Auth  //eg: user:pass
-        HttpProxy string //eg: http://proxyIp:proxyPort
+        Client    *HTTPClient //pooled client of the cluster, with auth, proxy and tls
 }
 
 func (s *ESAPIV0) ClusterHealth() *ClusterHealth {
 
         url := fmt.Sprintf("%s/_cluster/health", s.Host)
-        _, body, errs := Get(url, s.Auth,s.HttpProxy)
+        _, body, errs := s.Client.Get(url)
 
         if errs != nil {
                 return &ClusterHealth{Name: s.Host, Status: "unreachable"}
@@ -56,21 +55,72 @@ func (s *ESAPIV0) ClusterHealth() *ClusterHealth {
         return health
 }
 
-func (s *ESAPIV0) Bulk(data *bytes.Buffer) {
+// Bulk send the actions of data, data is reset if the request succeeds, and
+// actions rejected by the target are written back to it for retrying
+func (s *ESAPIV0) Bulk(data *bytes.Buffer) (*BulkResult, error) {
         if data == nil || data.Len() == 0 {
-                return
+                return &BulkResult{}, nil
+        }
+        if data.Bytes()[data.Len()-1] != '\n' {
+                data.WriteRune('\n')
         }
-        data.WriteRune('\n')
         url := fmt.Sprintf("%s/_bulk", s.Host)
 
-        body,err:=Request("POST",url,s.Auth,data,s.HttpProxy)
+        resp, body, errs := s.Client.Post(url, data.String())
+        if errs != nil {
+                return nil, errs[0]
+        }
+        if resp.StatusCode != 200 {
+                return &BulkResult{Status: resp.StatusCode}, errors.New("server error: " + body)
+        }
+        log.Trace(url, body)
 
+        result, retry, err := parseBulkResponse(data.Bytes(), []byte(body))
         if err != nil {
-                log.Error(err)
-                return
+                //the request was applied, it must not be sent again
+                return &BulkResult{Status: resp.StatusCode}, err
         }
-        log.Trace(url,string(body))
         data.Reset()
+        data.Write(retry)
+        return result, nil
+}
+
+// GetThreadPoolStats returns queued and rejected tasks of bulk and write
+// thread pools, summed over nodes
+func (s *ESAPIV0) GetThreadPoolStats() (*ThreadPoolStats, error) {
+        url := fmt.Sprintf("%s/_nodes/stats/thread_pool", s.Host)
+        resp, body, errs := s.Client.Get(url)
+        if errs != nil {
+                return nil, errs[0]
+        }
+        if resp.StatusCode != 200 {
+                return nil, errors.New(body)
+        }
+
+        nodes := struct {
+                Nodes map[string]struct {
+                        ThreadPool map[string]struct {
+                                Queue    int   `json:"queue"`
+                                Rejected int64 `json:"rejected"`
+                        } `json:"thread_pool"`
+                } `json:"nodes"`
+        }{}
+        err := json.Unmarshal([]byte(body), &nodes)
+        if err != nil {
+                return nil, err
+        }
+
+        stats := &ThreadPoolStats{}
+        for _, node := range nodes.Nodes {
+                //bulk before elasticsearch 6.3, write after
+                for _, name := range []string{"bulk", "write"} {
+                        if pool, ok := node.ThreadPool[name]; ok {
+                                stats.Queue += pool.Queue
+                                stats.Rejected += pool.Rejected
+                        }
+                }
+        }
+        return stats, nil
 }
 
 func (s *ESAPIV0) GetIndexSettings(indexNames string) (*Indexes, error) {
@@ -79,7 +129,7 @@ func (s *ESAPIV0) GetIndexSettings(indexNames string) (*Indexes, error) {
         allSettings := &Indexes{}
 
         url := fmt.Sprintf("%s/%s/_settings", s.Host, indexNames)
-        resp, body, errs := Get(url, s.Auth,s.HttpProxy)
+        resp, body, errs := s.Client.Get(url)
         if errs != nil {
                 return nil, errs[0]
         }
@@ -103,7 +153,7 @@ func (s *ESAPIV0) GetIndexSettings(indexNames string) (*Indexes, error) {
 
 func (s *ESAPIV0) GetIndexMappings(copyAllIndexes bool, indexNames string) (string, int, *Indexes, error) {
         url := fmt.Sprintf("%s/%s/_mapping", s.Host, indexNames)
-        resp, body, errs := Get(url, s.Auth,s.HttpProxy)
+        resp, body, errs := s.Client.Get(url)
         if errs != nil {
                 log.Error(errs)
                 return "", 0, nil, errs[0]
@@ -177,6 +227,61 @@ func (s *ESAPIV0) GetIndexMappings(copyAllIndexes bool, indexNames string) (stri
         return indexNames, i, &idxs, nil
 }
 
+func (s *ESAPIV0) GetIndexAliases(indexNames string) (*Indexes, error) {
+
+        allAliases := &Indexes{}
+
+        url := fmt.Sprintf("%s/%s/_alias", s.Host, indexNames)
+        resp, body, errs := s.Client.Get(url)
+        if errs != nil {
+                return nil, errs[0]
+        }
+        io.Copy(ioutil.Discard, resp.Body)
+        defer resp.Body.Close()
+
+        if resp.StatusCode != 200 {
+                return nil, errors.New(body)
+        }
+
+        log.Debug(body)
+
+        err := json.Unmarshal([]byte(body), allAliases)
+        if err != nil {
+                return nil, err
+        }
+
+        return allAliases, nil
+}
+
+func (s *ESAPIV0) UpdateIndexAliases(indexName string, aliases map[string]interface{}) error {
+        if len(aliases) == 0 {
+                return nil
+        }
+
+        actions := []interface{}{}
+        for alias, props := range aliases {
+                action := map[string]interface{}{}
+                if p, ok := props.(map[string]interface{}); ok {
+                        for k, v := range p {
+                                action[k] = v
+                        }
+                }
+                action["index"] = indexName
+                action["alias"] = alias
+                actions = append(actions, map[string]interface{}{"add": action})
+        }
+
+        body := bytes.Buffer{}
+        enc := json.NewEncoder(&body)
+        enc.Encode(map[string]interface{}{"actions": actions})
+        log.Debug("update aliases: ", indexName, aliases)
+
+        url := fmt.Sprintf("%s/_aliases", s.Host)
+        _, err := s.Client.Request("POST", url, &body)
+
+        return err
+}
+
 func getEmptyIndexSettings() map[string]interface{} {
         tempIndexSettings := map[string]interface{}{}
         tempIndexSettings["settings"] = map[string]interface{}{}
@@ -203,18 +308,18 @@ func (s *ESAPIV0) UpdateIndexSettings(name string, settings map[string]interface
                         log.Debug("update static index settings: ", name)
                         staticIndexSettings := getEmptyIndexSettings()
                         staticIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["analysis"] = set
-                        Post(fmt.Sprintf("%s/%s/_close", s.Host, name), s.Auth, "",s.HttpProxy)
+                        s.Client.Post(fmt.Sprintf("%s/%s/_close", s.Host, name), "")
                         body := bytes.Buffer{}
                         enc := json.NewEncoder(&body)
                         enc.Encode(staticIndexSettings)
-                        bodyStr, err := Request("PUT", url, s.Auth, &body,s.HttpProxy)
+                        bodyStr, err := s.Client.Request("PUT", url, &body)
                         if err != nil {
                                 log.Error(bodyStr, err)
                                 panic(err)
                                 return err
                         }
                         delete(settings["settings"].(map[string]interface{})["index"].(map[string]interface{}), "analysis")
-                        Post(fmt.Sprintf("%s/%s/_open", s.Host, name), s.Auth, "",s.HttpProxy)
+                        s.Client.Post(fmt.Sprintf("%s/%s/_open", s.Host, name), "")
                 }
         }
 
@@ -223,7 +328,7 @@ func (s *ESAPIV0) UpdateIndexSettings(name string, settings map[string]interface
         body := bytes.Buffer{}
         enc := json.NewEncoder(&body)
         enc.Encode(settings)
-        _, err := Request("PUT", url, s.Auth, &body,s.HttpProxy)
+        _, err := s.Client.Request("PUT", url, &body)
 
         return err
 }
@@ -241,7 +346,7 @@ func (s *ESAPIV0) UpdateIndexMapping(indexName string, settings map[string]inter
                 body := bytes.Buffer{}
                 enc := json.NewEncoder(&body)
                 enc.Encode(mapping)
-                res, err := Request("POST", url, s.Auth, &body,s.HttpProxy)
+                res, err := s.Client.Request("POST", url, &body)
                 if(err!=nil){
                         log.Error(url)
                         log.Error(body.String())
@@ -258,7 +363,7 @@ func (s *ESAPIV0) DeleteIndex(name string) (err error) {
 
         url := fmt.Sprintf("%s/%s", s.Host, name)
 
-        Request("DELETE", url, s.Auth, nil,s.HttpProxy)
+        s.Client.Request("DELETE", url, nil)
 
         log.Debug("delete index: ", name)
 
@@ -275,7 +380,7 @@ func (s *ESAPIV0) CreateIndex(name string, settings map[string]interface{}) (err
 
         url := fmt.Sprintf("%s/%s", s.Host, name)
 
-        resp, err := Request("PUT", url, s.Auth, &body,s.HttpProxy)
+        resp, err := s.Client.Request("PUT", url, &body)
         log.Debugf("response: %s",resp)
 
         return err
@@ -288,18 +393,22 @@ func (s *ESAPIV0) Refresh(name string) (err error) {
 
         url := fmt.Sprintf("%s/%s/_refresh", s.Host, name)
 
-        Post(url,s.Auth,"",s.HttpProxy)
+        s.Client.Post(url, "")
 
         return nil
 }
 
-func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount int,query string, slicedId,maxSlicedCount int, fields string) (scroll *Scroll, err error) {
+func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount int,query map[string]interface{}, sort []interface{}, slicedId,maxSlicedCount int, fields string) (scroll *Scroll, err error) {
 
         // curl -XGET 'http://es-0.9:9200/_search?search_type=scan&scroll=10m&size=50'
         url := fmt.Sprintf("%s/%s/_search?search_type=scan&scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
+        if sort != nil {
+                // scan ignores sorting, use a plain scroll instead
+                url = fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
+        }
 
         jsonBody:=""
-        if len(query) > 0 || len(fields) > 0 {
+        if query != nil || sort != nil || len(fields) > 0 {
                 queryBody := map[string]interface{}{}
                 if len(fields) > 0 {
                         if !strings.Contains(fields, ",") {
@@ -310,22 +419,24 @@ func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount
                         }
                 }
 
-                if len(query) > 0 {
-                        queryBody["query"] = map[string]interface{}{}
-                        queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-                        queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
+                if query != nil {
+                        queryBody["query"] = query
+                }
 
-                        jsonArray, err := json.Marshal(queryBody)
-                        if err != nil {
-                                log.Error(err)
+                if sort != nil {
+                        queryBody["sort"] = sort
+                }
 
-                        } else {
-                                jsonBody = string(jsonArray)
-                        }
+                jsonArray, err := json.Marshal(queryBody)
+                if err != nil {
+                        log.Error(err)
+
+                } else {
+                        jsonBody = string(jsonArray)
                 }
 
         }
-        resp, body, errs := Post(url, s.Auth,jsonBody,s.HttpProxy)
+        resp, body, errs := s.Client.Post(url, jsonBody)
 
 
 
@@ -347,7 +458,7 @@ func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount
                 return nil, errors.New(body)
         }
 
-        scroll = &Scroll{}
+        scroll = &Scroll{Bytes: len(body)}
         err = json.Unmarshal([]byte(body), scroll)
         if err != nil {
                 log.Error(err)
@@ -361,7 +472,7 @@ func (s *ESAPIV0) NextScroll(scrollTime string, scrollId string) (*Scroll, error
         //  curl -XGET 'http://es-0.9:9200/_search/scroll?scroll=5m'
         id := bytes.NewBufferString(scrollId)
         url := fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, id)
-        resp, body, errs := Get(url, s.Auth,s.HttpProxy)
+        resp, body, errs := s.Client.Get(url)
         if errs != nil {
                 log.Error(errs)
                 return nil, errs[0]
@@ -377,7 +488,7 @@ func (s *ESAPIV0) NextScroll(scrollTime string, scrollId string) (*Scroll, error
         log.Trace("next scroll,",url,body)
 
         // decode elasticsearch scroll response
-        scroll := &Scroll{}
+        scroll := &Scroll{Bytes: len(body)}
         err := json.Unmarshal([]byte(body), &scroll)
         if err != nil {
                 log.Error(body)
@@ -387,3 +498,50 @@ func (s *ESAPIV0) NextScroll(scrollTime string, scrollId string) (*Scroll, error
 
         return scroll, nil
 }
+
+func (s *ESAPIV0) ValidateQuery(indexNames string, query map[string]interface{}) error {
+        url := fmt.Sprintf("%s/%s/_validate/query?explain", s.Host, indexNames)
+
+        queryBody := map[string]interface{}{"query": query}
+        jsonArray, err := json.Marshal(queryBody)
+        if err != nil {
+                return err
+        }
+
+        resp, body, errs := s.Client.Post(url, string(jsonArray))
+        if errs != nil {
+                log.Error(errs)
+                return errs[0]
+        }
+        io.Copy(ioutil.Discard, resp.Body)
+        defer resp.Body.Close()
+
+        log.Trace("validate query,", url, body)
+
+        if resp.StatusCode != 200 {
+                return errors.New(body)
+        }
+
+        result := struct {
+                Valid        bool `json:"valid"`
+                Explanations []struct {
+                        Index string `json:"index"`
+                        Error string `json:"error"`
+                } `json:"explanations"`
+        }{}
+        err = json.Unmarshal([]byte(body), &result)
+        if err != nil {
+                return err
+        }
+
+        if !result.Valid {
+                for _, explanation := range result.Explanations {
+                        if len(explanation.Error) > 0 {
+                                return fmt.Errorf("invalid query, index: %s, error: %s", explanation.Index, explanation.Error)
+                        }
+                }
+                return errors.New("invalid query: " + string(jsonArray))
+        }
+
+        return nil
+}
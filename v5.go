@@ -35,8 +35,12 @@ func (s *ESAPIV5) ClusterHealth() *ClusterHealth {
         return s.ESAPIV0.ClusterHealth()
 }
 
-func (s *ESAPIV5) Bulk(data *bytes.Buffer){
-        s.ESAPIV0.Bulk(data)
+func (s *ESAPIV5) Bulk(data *bytes.Buffer) (*BulkResult, error) {
+        return s.ESAPIV0.Bulk(data)
+}
+
+func (s *ESAPIV5) GetThreadPoolStats() (*ThreadPoolStats, error) {
+        return s.ESAPIV0.GetThreadPoolStats()
 }
 
 func (s *ESAPIV5) GetIndexSettings(indexNames string) (*Indexes,error){
@@ -66,11 +70,23 @@ func (s *ESAPIV5) Refresh(name string) (err error) {
         return s.ESAPIV0.Refresh(name)
 }
 
-func (s *ESAPIV5) NewScroll(indexNames string,scrollTime string,docBufferCount int,query string, slicedId,maxSlicedCount int, fields string)(scroll *Scroll, err error){
+func (s *ESAPIV5) ValidateQuery(indexNames string,query map[string]interface{}) (error) {
+        return s.ESAPIV0.ValidateQuery(indexNames,query)
+}
+
+func (s *ESAPIV5) GetIndexAliases(indexNames string) (*Indexes,error) {
+        return s.ESAPIV0.GetIndexAliases(indexNames)
+}
+
+func (s *ESAPIV5) UpdateIndexAliases(indexName string,aliases map[string]interface{}) (error) {
+        return s.ESAPIV0.UpdateIndexAliases(indexName,aliases)
+}
+
+func (s *ESAPIV5) NewScroll(indexNames string,scrollTime string,docBufferCount int,query map[string]interface{}, sort []interface{}, slicedId,maxSlicedCount int, fields string)(scroll *Scroll, err error){
         url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime,docBufferCount)
 
         jsonBody:=""
-        if(len(query)>0||maxSlicedCount>0||len(fields)>0) {
+        if(query!=nil||sort!=nil||maxSlicedCount>0||len(fields)>0) {
                 queryBody := map[string]interface{}{}
 
 
@@ -83,10 +99,12 @@ func (s *ESAPIV5) NewScroll(indexNames string,scrollTime string,docBufferCount i
                         }
                 }
 
-                if(len(query)>0){
-                        queryBody["query"] = map[string]interface{}{}
-                        queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-                        queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
+                if(query!=nil){
+                        queryBody["query"] = query
+                }
+
+                if(sort!=nil){
+                        queryBody["sort"] = sort
                 }
 
                 if(maxSlicedCount>1){
@@ -105,7 +123,7 @@ func (s *ESAPIV5) NewScroll(indexNames string,scrollTime string,docBufferCount i
                 }
         }
 
-        resp, body, errs := Post(url, s.Auth,jsonBody,s.HttpProxy)
+        resp, body, errs := s.Client.Post(url, jsonBody)
 
         if errs != nil {
                 log.Error(errs)
@@ -125,7 +143,7 @@ func (s *ESAPIV5) NewScroll(indexNames string,scrollTime string,docBufferCount i
                 return nil,err
         }
 
-        scroll = &Scroll{}
+        scroll = &Scroll{Bytes: len(body)}
         err = json.Unmarshal([]byte(body),scroll)
         if err != nil {
                 log.Error(err)
@@ -139,7 +157,7 @@ func (s *ESAPIV5) NextScroll(scrollTime string,scrollId string)(*Scroll,error)
         id := bytes.NewBufferString(scrollId)
 
         url:=fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, id)
-        resp,body, errs := Get(url,s.Auth,s.HttpProxy)
+        resp,body, errs := s.Client.Get(url)
         if errs != nil {
                 log.Error(errs)
                 return nil,errs[0]
@@ -152,7 +170,7 @@ func (s *ESAPIV5) NextScroll(scrollTime string,scrollId string)(*Scroll,error)
         }
 
         // decode elasticsearch scroll response
-        scroll := &Scroll{}
+        scroll := &Scroll{Bytes: len(body)}
         err:= json.Unmarshal([]byte(body), &scroll)
         if err != nil {
                 log.Error(body)
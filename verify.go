@@ -0,0 +1,198 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/cihub/seelog"
+)
+
+type VerifyDumpCommand struct {
+}
+
+// Run verify dump files of --input_file against the manifest
+func (v *VerifyDumpCommand) Run(c *Config) error {
+	if len(c.DumpInputFile) == 0 {
+		return errors.New("input_file is required for verify-dump")
+	}
+
+	files, err := ListDumpFiles(c.DumpInputFile)
+	if err != nil {
+		return err
+	}
+
+	manifestFile := c.InputManifest
+	if len(manifestFile) == 0 {
+		manifestFile = FindDumpManifest(c.DumpInputFile)
+	}
+	if len(manifestFile) == 0 {
+		return errors.New("manifest of " + c.DumpInputFile + " not found, use --input_manifest to specify it")
+	}
+	manifest, err := LoadDumpManifest(manifestFile)
+	if err != nil {
+		return err
+	}
+
+	lineCount, err := VerifyDumpFiles(files, manifest, filepath.Dir(manifestFile), c.Compress)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("%d dump files verified, %d documents", len(files), lineCount)
+	return nil
+}
+
+// VerifyDumpFiles check that no part listed in the manifest is missing, and
+// every file matches the checksum and document count recorded at dump time,
+// returns the total number of documents of files
+func VerifyDumpFiles(files []string, manifest *DumpManifest, manifestDir string, compress string) (int, error) {
+	parts := map[string]DumpFileInfo{}
+	for _, info := range manifest.Files {
+		parts[info.Name] = info
+		if !checkFileIsExist(filepath.Join(manifestDir, info.Name)) {
+			return 0, errors.New("dump file listed in manifest is missing: " + info.Name)
+		}
+	}
+
+	format, err := getDumpFormat(manifest.FileFormat)
+	if err != nil {
+		return 0, err
+	}
+
+	lineCount := 0
+	for _, file := range files {
+		info, ok := parts[filepath.Base(file)]
+		if !ok {
+			return 0, errors.New("dump file not found in manifest: " + file)
+		}
+
+		//parquet files are verified by checksum only
+		sum, lines, err := verifyDumpFile(file, compress, format, format != dumpFormatParquet)
+		if err != nil {
+			return 0, err
+		}
+		if len(info.SHA256) > 0 && sum != info.SHA256 {
+			return 0, fmt.Errorf("checksum mismatch of dump file %s, expected: %s, actual: %s", file, info.SHA256, sum)
+		}
+		if format == dumpFormatParquet {
+			lines = info.Docs
+		}
+		if lines != info.Docs {
+			return 0, fmt.Errorf("document count mismatch of dump file %s, expected: %d, actual: %d", file, info.Docs, lines)
+		}
+
+		log.Debugf("dump file %s verified, %d documents", file, lines)
+		lineCount += lines
+	}
+
+	return lineCount, nil
+}
+
+// verifyDumpFile returns the checksum of the file, and make sure every line
+// is complete and decodable if lines are checked, in one pass of reading,
+// returns the checksum and the number of documents
+func verifyDumpFile(file string, compress string, format string, checkLines bool) (string, int, error) {
+	compression, err := getCompression(file, compress)
+	if err != nil {
+		return "", 0, err
+	}
+	raw, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer raw.Close()
+
+	hash := sha256.New()
+	tee := io.TeeReader(raw, hash)
+	docCount := 0
+	if checkLines {
+		f, err := newDumpReader(ioutil.NopCloser(tee), compression)
+		if err != nil {
+			return "", 0, err
+		}
+		defer f.Close()
+		if docCount, err = verifyDumpLines(file, f, format); err != nil {
+			return "", docCount, err
+		}
+	}
+	//the rest not consumed by the decompressor is still part of the checksum
+	if _, err = io.Copy(ioutil.Discard, tee); err != nil {
+		return "", docCount, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), docCount, nil
+}
+
+// verifyDumpLines make sure every line is complete and decodable, returns
+// the number of documents
+func verifyDumpLines(file string, f io.Reader, format string) (int, error) {
+	r := bufio.NewReader(f)
+	decoder, err := newDumpDecoder(format, nil)
+	if err != nil {
+		return 0, err
+	}
+	lineCount := 0
+	docCount := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			if f, ok := decoder.(finishDecoder); ok {
+				if err := f.Finish(); err != nil {
+					return docCount, fmt.Errorf("invalid dump file %s, %v", file, err)
+				}
+			}
+			break
+		}
+		if err == io.EOF {
+			return docCount, fmt.Errorf("dump file %s is truncated, last line is incomplete", file)
+		}
+		if err != nil {
+			return docCount, fmt.Errorf("failed reading dump file %s, %v", file, err)
+		}
+		lineCount++
+		doc, err := decoder.Decode(line)
+		if err != nil {
+			return docCount, fmt.Errorf("invalid line %d of dump file %s, %v", lineCount, file, err)
+		}
+		if doc != nil {
+			docCount++
+		}
+	}
+	return docCount, nil
+}
+
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
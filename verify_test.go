@@ -0,0 +1,88 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyDumpFiles(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "dump.json")
+	w := &DumpWriter{File: file, MaxDocs: 2}
+	for i := 0; i < 3; i++ {
+		w.Write("a", []byte("{\"_id\":\"1\"}\n"))
+	}
+	if err := w.Close(); err != nil {
+		test.Fatal(err)
+	}
+	manifest := &DumpManifest{Indices: map[string]*DumpIndexManifest{}}
+	manifest.SetDumpResult(w.Counts(), w.Files())
+	manifest.Write(file + dumpManifestSuffix)
+
+	files, err := ListDumpFiles(file)
+	if err != nil || len(files) != 2 {
+		test.Fatalf("unexpected files %v, %v", files, err)
+	}
+
+	lines, err := VerifyDumpFiles(files, manifest, dir, "")
+	if err != nil || lines != 3 {
+		test.Errorf("expected 3 lines verified, got %d, %v", lines, err)
+	}
+
+	//truncate the last line of the second part
+	ioutil.WriteFile(files[1], []byte("{\"_id\":"), 0644)
+	if _, err = VerifyDumpFiles(files, manifest, dir, ""); err == nil {
+		test.Error("expected truncated file detected")
+	}
+
+	//a missing part should be detected too
+	os.Remove(files[1])
+	if _, err = VerifyDumpFiles(files[:1], manifest, dir, ""); err == nil {
+		test.Error("expected missing file detected")
+	}
+}
+
+func TestVerifyOverwrittenDump(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "esm")
+	defer os.RemoveAll(dir)
+
+	//dump twice to the same file, the manifest of the second run should match
+	file := filepath.Join(dir, "dump.json.gz")
+	var manifest *DumpManifest
+	for run := 0; run < 2; run++ {
+		w := &DumpWriter{File: file, Truncate: true}
+		for i := 0; i < 3; i++ {
+			w.Write("a", []byte("{\"_id\":\"1\"}\n"))
+		}
+		if err := w.Close(); err != nil {
+			test.Fatal(err)
+		}
+		manifest = &DumpManifest{Indices: map[string]*DumpIndexManifest{}}
+		manifest.SetDumpResult(w.Counts(), w.Files())
+	}
+
+	lines, err := VerifyDumpFiles([]string{file}, manifest, dir, "")
+	if err != nil || lines != 3 {
+		test.Errorf("expected 3 lines verified, got %d, %v", lines, err)
+	}
+}